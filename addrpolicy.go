@@ -0,0 +1,136 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/decred/dcrd/txscript/v4/stdaddr"
+)
+
+// Address types which may be allowed by the addresstype option.
+const (
+	addrTypeP2PKHEcdsa   = "p2pkh-ecdsa"
+	addrTypeP2PKHEd25519 = "p2pkh-ed25519"
+	addrTypeP2PKHSchnorr = "p2pkh-schnorr"
+	addrTypeP2PK         = "p2pk"
+	addrTypeP2SH         = "p2sh"
+
+	// addrTypeNonstandard is the type of any other address.  It is never
+	// allowed.
+	addrTypeNonstandard = "nonstandard"
+)
+
+// addressTypes lists every known address type.  All of them are allowed when
+// no addresstype option is given.
+var addressTypes = []string{
+	addrTypeP2PKHEcdsa,
+	addrTypeP2PKHEd25519,
+	addrTypeP2PKHSchnorr,
+	addrTypeP2PK,
+	addrTypeP2SH,
+}
+
+// parseAddressTypes returns the set of allowed address types named by types.
+func parseAddressTypes(types []string) (map[string]bool, error) {
+	allowed := make(map[string]bool)
+	if len(types) == 0 {
+		for _, t := range addressTypes {
+			allowed[t] = true
+		}
+		return allowed, nil
+	}
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		known := false
+		for _, k := range addressTypes {
+			known = known || k == t
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown address type %q, expected "+
+				"one of %s", t, strings.Join(addressTypes, ", "))
+		}
+		allowed[t] = true
+	}
+	return allowed, nil
+}
+
+// addressType returns the policy name of the type of addr.
+func addressType(addr stdaddr.Address) string {
+	switch addr.(type) {
+	case *stdaddr.AddressPubKeyHashEcdsaSecp256k1V0:
+		return addrTypeP2PKHEcdsa
+	case *stdaddr.AddressPubKeyHashEd25519V0:
+		return addrTypeP2PKHEd25519
+	case *stdaddr.AddressPubKeyHashSchnorrSecp256k1V0:
+		return addrTypeP2PKHSchnorr
+	case *stdaddr.AddressPubKeyEcdsaSecp256k1V0,
+		*stdaddr.AddressPubKeyEd25519V0,
+		*stdaddr.AddressPubKeySchnorrSecp256k1V0:
+		return addrTypeP2PK
+	case *stdaddr.AddressScriptHashV0:
+		return addrTypeP2SH
+	}
+	return addrTypeNonstandard
+}
+
+// allowedAddressTypes returns the allowed address types in a stable order for
+// error messages.
+func allowedAddressTypes() string {
+	types := make([]string, 0, len(cfg.addressTypes))
+	for t := range cfg.addressTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return strings.Join(types, ", ")
+}
+
+// checkAddressPolicy returns an error explaining why payouts to addr are
+// refused, if they are.  The address must be of an allowed type and must not
+// belong to any of the faucet wallets, since paying it would only move coins
+// back to the faucet.  Staking requests additionally need an address which can
+// be committed to in tickets.  The return addresses of the faucet are refused
+// even when their wallet cannot be reached, while addresses of other wallets
+// which cannot be reached are not detected, which is logged as a warning.
+func checkAddressPolicy(ctx context.Context, addr stdaddr.Address, staking bool) error {
+	typ := addressType(addr)
+	if typ == addrTypeNonstandard {
+		log.Debugf("address %v has nonstandard type %T", addr, addr)
+	}
+	if !cfg.addressTypes[typ] {
+		return newFaucetError(errCodeAddressTypeNotAllowed, addr, typ,
+			allowedAddressTypes())
+	}
+	if _, ok := addr.(stdaddr.StakeAddress); staking && !ok {
+		return newFaucetError(errCodeAddressNotStakeable, addr, typ)
+	}
+
+	if addr.String() == cfg.WalletAddress {
+		return newFaucetError(errCodeOwnAddress, addr)
+	}
+	if _, ok := state.returnAddress(addr.String()); ok {
+		return newFaucetError(errCodeOwnAddress, addr)
+	}
+	for _, w := range wallets.backends {
+		if !w.isHealthy() || w.rpc.Disconnected() {
+			walletLog.Warnf("Unable to check whether address %v "+
+				"belongs to unavailable wallet %s", addr, w)
+			continue
+		}
+		res, err := w.client.ValidateAddress(ctx, addr)
+		if err != nil {
+			walletLog.Warnf("Unable to validate address %v with wallet "+
+				"%s: %v", addr, w, err)
+			return newFaucetError(errCodePayoutFailed, err)
+		}
+		if res.IsMine {
+			return newFaucetError(errCodeOwnAddress, addr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/gorilla/mux"
+)
+
+// adminRequest is the JSON body accepted by the admin API endpoints which
+// modify state.
+type adminRequest struct {
+	IP      string `json:"ip"`
+	Subject string `json:"subject"`
+	Address string `json:"address"`
+
+	// The following fields describe an API key.  Amounts are in DCR.
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	DailyQuota float64 `json:"dailyquota"`
+	Rate       int     `json:"rate"`
+	MaxAmount  float64 `json:"maxamount"`
+}
+
+// adminResult is the JSON reply of the admin API endpoints which modify
+// state.
+type adminResult struct {
+	Result string `json:"result"`
+}
+
+// adminError is the JSON reply of the admin API on failure.
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// adminRouter returns the router serving the admin API.  All requests must be
+// authenticated with the admin token as a bearer token.
+func adminRouter() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/status", adminStatus).Methods("GET")
+	r.HandleFunc("/admin/payouts", adminPayouts).Methods("GET")
+	r.HandleFunc("/admin/blocked", adminBlocked).Methods("GET")
+	r.HandleFunc("/admin/block", adminBlock).Methods("POST")
+	r.HandleFunc("/admin/unblock", adminUnblock).Methods("POST")
+	r.HandleFunc("/admin/clearcooldown", adminClearCooldown).Methods("POST")
+	r.HandleFunc("/admin/pause", adminPause).Methods("POST")
+	r.HandleFunc("/admin/resume", adminResume).Methods("POST")
+	r.HandleFunc("/admin/apikeys", adminAPIKeys).Methods("GET")
+	r.HandleFunc("/admin/apikeys", adminCreateAPIKey).Methods("POST")
+	r.HandleFunc("/admin/apikeys/revoke", adminRevokeAPIKey).Methods("POST")
+	r.Use(adminAuth)
+	return r
+}
+
+// adminAuth is middleware rejecting requests which do not carry the admin
+// token.
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			log.Warnf("admin: unauthorized request from %v", r.RemoteAddr)
+			writeAdminJSON(w, http.StatusUnauthorized,
+				&adminError{Error: "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeAdminJSON writes v as the JSON reply with the provided status code.
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("admin: failed to write reply: %v", err)
+	}
+}
+
+// writeAdminError writes an error reply.
+func writeAdminError(w http.ResponseWriter, code int, err error) {
+	writeAdminJSON(w, code, &adminError{Error: err.Error()})
+}
+
+// decodeAdminRequest decodes the JSON body of r.
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request) (*adminRequest, bool) {
+	var req adminRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return nil, false
+	}
+	return &req, true
+}
+
+// adminStatusResponse is the reply of the admin status API.  It extends the
+// public status with the state of every wallet.
+type adminStatusResponse struct {
+	*statusResponse
+	Wallets []walletStatus `json:"wallets"`
+}
+
+// adminStatus is the handler for GET requests to "/admin/status".
+func adminStatus(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, &adminStatusResponse{
+		statusResponse: currentStatus(),
+		Wallets:        wallets.status(),
+	})
+}
+
+// parseTimeParam parses a time query parameter given either as a date
+// (2006-01-02) in UTC or in RFC3339 format.
+func parseTimeParam(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// adminPayouts is the handler for GET requests to "/admin/payouts".  The
+// payouts can be filtered with the ip, address, since, until and limit query
+// parameters.
+func adminPayouts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := payoutFilter{
+		IP:      q.Get("ip"),
+		Address: q.Get("address"),
+	}
+	var err error
+	if s := q.Get("since"); s != "" {
+		if f.Since, err = parseTimeParam(s); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if s := q.Get("until"); s != "" {
+		if f.Until, err = parseTimeParam(s); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil {
+			writeAdminError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	payouts := state.queryPayouts(&f)
+	if payouts == nil {
+		payouts = []payoutRecord{}
+	}
+	writeAdminJSON(w, http.StatusOK, payouts)
+}
+
+// adminBlocked is the handler for GET requests to "/admin/blocked".
+func adminBlocked(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, state.blocked())
+}
+
+// adminSetBlocked blocks or unblocks the address of the request.
+func adminSetBlocked(w http.ResponseWriter, r *http.Request, blocked bool) {
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Address == "" {
+		writeAdminJSON(w, http.StatusBadRequest,
+			&adminError{Error: "address is required"})
+		return
+	}
+	if err := state.setBlocked(req.Address, blocked); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	action := "blocked"
+	if !blocked {
+		action = "unblocked"
+	}
+	log.Infof("admin: %s address %v", action, req.Address)
+	writeAdminJSON(w, http.StatusOK, &adminResult{
+		Result: action + " " + req.Address,
+	})
+}
+
+// adminBlock is the handler for POST requests to "/admin/block".
+func adminBlock(w http.ResponseWriter, r *http.Request) {
+	adminSetBlocked(w, r, true)
+}
+
+// adminUnblock is the handler for POST requests to "/admin/unblock".
+func adminUnblock(w http.ResponseWriter, r *http.Request) {
+	adminSetBlocked(w, r, false)
+}
+
+// adminClearCooldown is the handler for POST requests to
+// "/admin/clearcooldown".  Either the cooldowns of an IP or those of a logged
+// in user, identified by the subject of the payout records, are cleared.
+// Without either the cooldowns of all clients are cleared.
+func adminClearCooldown(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	client := req.IP
+	if req.Subject != "" {
+		if req.IP != "" {
+			writeAdminError(w, http.StatusBadRequest,
+				errors.New("ip and subject may not both be set"))
+			return
+		}
+		client = subjectClientID(req.Subject)
+	}
+	n, err := state.clearCooldown(client)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	log.Infof("admin: cleared %d cooldown(s) (ip: %q, subject: %q)", n,
+		req.IP, req.Subject)
+	writeAdminJSON(w, http.StatusOK, &adminResult{
+		Result: "cleared " + strconv.Itoa(n) + " cooldown(s)",
+	})
+}
+
+// adminSetPaused suspends or resumes payouts.
+func adminSetPaused(w http.ResponseWriter, paused bool) {
+	if err := state.setPaused(paused); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	result := "paused"
+	if !paused {
+		result = "resumed"
+	}
+	log.Infof("admin: payouts %s", result)
+	events.publish(eventPaused, &pausedEvent{Paused: paused})
+	writeAdminJSON(w, http.StatusOK, &adminResult{Result: result})
+}
+
+// adminPause is the handler for POST requests to "/admin/pause".
+func adminPause(w http.ResponseWriter, r *http.Request) {
+	adminSetPaused(w, true)
+}
+
+// adminResume is the handler for POST requests to "/admin/resume".
+func adminResume(w http.ResponseWriter, r *http.Request) {
+	adminSetPaused(w, false)
+}
+
+// adminAPIKeys is the handler for GET requests to "/admin/apikeys".  It lists
+// the API keys with their limits and usage counters.
+func adminAPIKeys(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, apiKeys.list())
+}
+
+// adminCreateAPIKey is the handler for POST requests to "/admin/apikeys".  The
+// reply contains the new key, which can not be retrieved later.
+func adminCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Name == "" {
+		writeAdminJSON(w, http.StatusBadRequest,
+			&adminError{Error: "name is required"})
+		return
+	}
+	dailyQuota, err := dcrutil.NewAmount(req.DailyQuota)
+	if err != nil || dailyQuota < 0 {
+		writeAdminJSON(w, http.StatusBadRequest,
+			&adminError{Error: "invalid daily quota"})
+		return
+	}
+	maxAmount, err := dcrutil.NewAmount(req.MaxAmount)
+	if err != nil || maxAmount < 0 {
+		writeAdminJSON(w, http.StatusBadRequest,
+			&adminError{Error: "invalid maximum amount"})
+		return
+	}
+	if req.Rate < 0 {
+		writeAdminJSON(w, http.StatusBadRequest,
+			&adminError{Error: "invalid rate"})
+		return
+	}
+
+	info, err := apiKeys.create(req.Name, dailyQuota, req.Rate, maxAmount)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	log.Infof("admin: created API key %s (%s)", info.ID, info.Name)
+	writeAdminJSON(w, http.StatusOK, info)
+}
+
+// adminRevokeAPIKey is the handler for POST requests to
+// "/admin/apikeys/revoke".
+func adminRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.ID == "" {
+		writeAdminJSON(w, http.StatusBadRequest,
+			&adminError{Error: "id is required"})
+		return
+	}
+	if err := apiKeys.revoke(req.ID); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	log.Infof("admin: revoked API key %s", req.ID)
+	writeAdminJSON(w, http.StatusOK, &adminResult{
+		Result: "revoked " + req.ID,
+	})
+}
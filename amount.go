@@ -0,0 +1,123 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+// maxDecimalPlaces is the number of decimal places of a DCR amount.
+const maxDecimalPlaces = 8
+
+// Units accepted as a suffix of amounts.
+const (
+	unitDCR   = "dcr"
+	unitAtoms = "atoms"
+)
+
+// isDigits returns whether s is a non-empty string of ASCII digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseAtoms parses a non-negative integer number of atoms.
+func parseAtoms(s string) (dcrutil.Amount, error) {
+	if !isDigits(s) {
+		return 0, newFaucetError(errCodeAmountAtomsInvalid, s)
+	}
+	atoms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || atoms > dcrutil.MaxAmount {
+		return 0, newFaucetError(errCodeAmountTooLarge, s,
+			dcrutil.Amount(dcrutil.MaxAmount))
+	}
+	return dcrutil.Amount(atoms), nil
+}
+
+// parseDCR parses a non-negative decimal number of DCR with at most eight
+// decimal places without any loss of precision.
+func parseDCR(s string) (dcrutil.Amount, error) {
+	whole, frac, hasPoint := strings.Cut(s, ".")
+	if !isDigits(whole) || (hasPoint && !isDigits(frac)) {
+		return 0, newFaucetError(errCodeAmountInvalid, s)
+	}
+	if len(frac) > maxDecimalPlaces {
+		return 0, newFaucetError(errCodeAmountTooPrecise, s,
+			maxDecimalPlaces)
+	}
+
+	// The whole part of the maximum amount has eight digits, so anything
+	// longer can not be valid and would overflow below.
+	whole = strings.TrimLeft(whole, "0")
+	if len(whole) > 8 {
+		return 0, newFaucetError(errCodeAmountTooLarge, s,
+			dcrutil.Amount(dcrutil.MaxAmount))
+	}
+	var atoms int64
+	if whole != "" {
+		n, err := strconv.ParseInt(whole, 10, 64)
+		if err != nil {
+			return 0, newFaucetError(errCodeAmountInvalid, s)
+		}
+		atoms = n * dcrutil.AtomsPerCoin
+	}
+	if frac != "" {
+		frac += strings.Repeat("0", maxDecimalPlaces-len(frac))
+		n, err := strconv.ParseInt(frac, 10, 64)
+		if err != nil {
+			return 0, newFaucetError(errCodeAmountInvalid, s)
+		}
+		atoms += n
+	}
+	if atoms > dcrutil.MaxAmount {
+		return 0, newFaucetError(errCodeAmountTooLarge, s,
+			dcrutil.Amount(dcrutil.MaxAmount))
+	}
+	return dcrutil.Amount(atoms), nil
+}
+
+// parseAmount strictly parses a requested amount.  The amount is in DCR unless
+// it carries a "DCR" or "atoms" unit suffix, optionally separated by spaces.
+// Signs, exponents, hexadecimal notation, NaN and infinities are rejected.
+func parseAmount(s string) (dcrutil.Amount, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, newFaucetError(errCodeAmountEmpty)
+	}
+
+	lower := strings.ToLower(s)
+	switch {
+	case strings.HasSuffix(lower, unitAtoms):
+		return parseAtoms(strings.TrimSpace(s[:len(s)-len(unitAtoms)]))
+	case strings.HasSuffix(lower, unitDCR):
+		return parseDCR(strings.TrimSpace(s[:len(s)-len(unitDCR)]))
+	}
+	return parseDCR(s)
+}
+
+// parseAmountInputs parses the amount of a request given either in DCR with
+// the amount parameter or in atoms with the amount_atoms parameter.  A zero
+// amount is returned when neither is set.
+func parseAmountInputs(amountInput, amountAtomsInput string) (dcrutil.Amount, error) {
+	switch {
+	case amountInput != "" && amountAtomsInput != "":
+		return 0, newFaucetError(errCodeAmountConflict)
+	case amountAtomsInput != "":
+		return parseAtoms(strings.TrimSpace(amountAtomsInput))
+	case amountInput != "":
+		return parseAmount(amountInput)
+	}
+	return 0, nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+// errorCode returns the code of a faucetError, or an empty string when err is
+// nil or another error.
+func errorCode(err error) string {
+	var fe *faucetError
+	if errors.As(err, &fe) {
+		return fe.Code
+	}
+	return ""
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		input string
+		want  dcrutil.Amount
+		code  string
+	}{
+		{"1", 1e8, ""},
+		{"0.5", 5e7, ""},
+		{"00.00000001", 1, ""},
+		{" 2.5 ", 25e7, ""},
+		{"21000000", 21e14, ""},
+		{"1DCR", 1e8, ""},
+		{"1.25 dcr", 125e6, ""},
+		{"100 atoms", 100, ""},
+		{"100ATOMS", 100, ""},
+		{"", 0, errCodeAmountEmpty},
+		{"1e-3", 0, errCodeAmountInvalid},
+		{"NaN", 0, errCodeAmountInvalid},
+		{"Inf", 0, errCodeAmountInvalid},
+		{"0x1p0", 0, errCodeAmountInvalid},
+		{"1.", 0, errCodeAmountInvalid},
+		{".5", 0, errCodeAmountInvalid},
+		{"+1", 0, errCodeAmountInvalid},
+		{"-1", 0, errCodeAmountInvalid},
+		{"1,5", 0, errCodeAmountInvalid},
+		{"DCR", 0, errCodeAmountInvalid},
+		{"0.123456789", 0, errCodeAmountTooPrecise},
+		{"21000001", 0, errCodeAmountTooLarge},
+		{"999999999999999999999", 0, errCodeAmountTooLarge},
+		{"1.5 atoms", 0, errCodeAmountAtomsInvalid},
+		{"-1 atoms", 0, errCodeAmountAtomsInvalid},
+		{"9223372036854775808 atoms", 0, errCodeAmountTooLarge},
+	}
+	for _, test := range tests {
+		got, err := parseAmount(test.input)
+		if code := errorCode(err); code != test.code {
+			t.Errorf("parseAmount(%q): error %v, want code %q",
+				test.input, err, test.code)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseAmount(%q) = %v, want %v", test.input,
+				got, test.want)
+		}
+	}
+}
+
+func TestParseAmountInputs(t *testing.T) {
+	tests := []struct {
+		amount, amountAtoms string
+		want                dcrutil.Amount
+		code                string
+	}{
+		{"", "", 0, ""},
+		{"1.5", "", 15e7, ""},
+		{"", "150000000", 15e7, ""},
+		{"", " 1 ", 1, ""},
+		{"1", "100000000", 0, errCodeAmountConflict},
+		{"", "1.5", 0, errCodeAmountAtomsInvalid},
+		{"", "1e8", 0, errCodeAmountAtomsInvalid},
+		{"", "-1", 0, errCodeAmountAtomsInvalid},
+		{"", "2100000000000001", 0, errCodeAmountTooLarge},
+	}
+	for _, test := range tests {
+		got, err := parseAmountInputs(test.amount, test.amountAtoms)
+		if code := errorCode(err); code != test.code {
+			t.Errorf("parseAmountInputs(%q, %q): error %v, want "+
+				"code %q", test.amount, test.amountAtoms, err,
+				test.code)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseAmountInputs(%q, %q) = %v, want %v",
+				test.amount, test.amountAtoms, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+const (
+	// apiKeysFilename is the name of the file in the data directory which
+	// holds the API keys.
+	apiKeysFilename = "apikeys.json"
+
+	// apiKeyPrefix is prepended to every API key so that leaked keys are
+	// easy to recognize.
+	apiKeyPrefix = "tfk_"
+
+	// apiKeyUsageFlushInterval is how often changed usage counters are
+	// written to disk.
+	apiKeyUsageFlushInterval = time.Minute
+)
+
+// apiKey is an API key of a programmatic client.  Only the SHA-256 hash of the
+// key is stored.  Amounts are in atoms.
+type apiKey struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+	Revoked time.Time `json:"revoked,omitempty"`
+
+	// DailyQuota is the maximum amount paid out to the key within 24
+	// hours.  Zero means unlimited.
+	DailyQuota dcrutil.Amount `json:"dailyquota"`
+
+	// Rate is the maximum number of payouts to the key within an hour.
+	// Zero means unlimited.
+	Rate int `json:"rate"`
+
+	// MaxAmount is the maximum amount of a single payout.  Zero means the
+	// limits of the payout tiers apply alone.
+	MaxAmount dcrutil.Amount `json:"maxamount"`
+
+	// Usage counters.
+	Requests int64          `json:"requests"`
+	Payouts  int64          `json:"payouts"`
+	Sent     dcrutil.Amount `json:"sent"`
+	LastUsed time.Time      `json:"lastused,omitempty"`
+}
+
+// revoked returns whether the key was revoked.
+func (k *apiKey) revoked() bool {
+	return !k.Revoked.IsZero()
+}
+
+// apiKeyInfo describes an API key in the admin API.  Amounts are in DCR.
+type apiKeyInfo struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Created    time.Time  `json:"created"`
+	Revoked    *time.Time `json:"revoked,omitempty"`
+	DailyQuota float64    `json:"dailyquota"`
+	Rate       int        `json:"rate"`
+	MaxAmount  float64    `json:"maxamount"`
+	Requests   int64      `json:"requests"`
+	Payouts    int64      `json:"payouts"`
+	Sent       float64    `json:"sent"`
+	SentToday  float64    `json:"senttoday"`
+	LastUsed   *time.Time `json:"lastused,omitempty"`
+
+	// Key is the API key itself.  It is only returned when the key is
+	// created.
+	Key string `json:"key,omitempty"`
+}
+
+// info returns the admin API description of the key.
+func (k *apiKey) info() *apiKeyInfo {
+	i := &apiKeyInfo{
+		ID:         k.ID,
+		Name:       k.Name,
+		Created:    k.Created,
+		DailyQuota: k.DailyQuota.ToCoin(),
+		Rate:       k.Rate,
+		MaxAmount:  k.MaxAmount.ToCoin(),
+		Requests:   k.Requests,
+		Payouts:    k.Payouts,
+		Sent:       k.Sent.ToCoin(),
+	}
+	if k.revoked() {
+		revoked := k.Revoked
+		i.Revoked = &revoked
+	}
+	if !k.LastUsed.IsZero() {
+		lastUsed := k.LastUsed
+		i.LastUsed = &lastUsed
+	}
+	return i
+}
+
+// apiKeyStore holds the API keys and persists them in the data directory.
+type apiKeyStore struct {
+	path string
+
+	mtx    sync.Mutex
+	keys   []*apiKey
+	byHash map[string]*apiKey
+	dirty  bool // usage counters changed since the last save
+}
+
+// apiKeys holds the API keys of programmatic clients.  It is opened in main.
+var apiKeys *apiKeyStore
+
+// openAPIKeyStore loads the API keys from dir.
+func openAPIKeyStore(dir string) (*apiKeyStore, error) {
+	s := &apiKeyStore{
+		path:   filepath.Join(dir, apiKeysFilename),
+		byHash: make(map[string]*apiKey),
+	}
+	b, err := os.ReadFile(s.path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.keys); err != nil {
+		return nil, fmt.Errorf("%s: %v", apiKeysFilename, err)
+	}
+	for _, k := range s.keys {
+		s.byHash[k.Hash] = k
+	}
+	return s, nil
+}
+
+// save writes the keys to disk.  It must be called with the mutex held.
+func (s *apiKeyStore) save() error {
+	b, err := json.MarshalIndent(s.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// flush writes the usage counters to disk when they changed since the last
+// save.
+func (s *apiKeyStore) flush() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !s.dirty {
+		return
+	}
+	if err := s.save(); err != nil {
+		log.Errorf("failed to save API key usage: %v", err)
+	}
+}
+
+// run periodically writes changed usage counters to disk until quit is
+// closed.  Counters changed after the last flush are written by flush on
+// shutdown.
+func (s *apiKeyStore) run(quit <-chan struct{}) {
+	ticker := time.NewTicker(apiKeyUsageFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+// hashAPIKey returns the hex encoded SHA-256 hash of key.
+func hashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// create adds a new key and returns its description including the key,
+// which is not stored and can not be retrieved again.
+func (s *apiKeyStore) create(name string, dailyQuota dcrutil.Amount, rate int,
+	maxAmount dcrutil.Amount) (*apiKeyInfo, error) {
+
+	var id [4]byte
+	var secret [32]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(secret[:]); err != nil {
+		return nil, err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret[:])
+	k := &apiKey{
+		ID:         hex.EncodeToString(id[:]),
+		Name:       name,
+		Hash:       hashAPIKey(key),
+		Created:    time.Now(),
+		DailyQuota: dailyQuota,
+		Rate:       rate,
+		MaxAmount:  maxAmount,
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.keys = append(s.keys, k)
+	s.byHash[k.Hash] = k
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+
+	info := k.info()
+	info.Key = key
+	return info, nil
+}
+
+// revoke revokes the key with the provided ID.
+func (s *apiKeyStore) revoke(id string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, k := range s.keys {
+		if k.ID == id {
+			if !k.revoked() {
+				k.Revoked = time.Now()
+			}
+			return s.save()
+		}
+	}
+	return fmt.Errorf("unknown API key %q", id)
+}
+
+// list returns the descriptions of all keys, most recently created first.
+func (s *apiKeyStore) list() []*apiKeyInfo {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	dayAgo := time.Now().Add(-24 * time.Hour)
+	infos := make([]*apiKeyInfo, 0, len(s.keys))
+	for _, k := range s.keys {
+		info := k.info()
+		_, sent := state.keyUsageSince(dayAgo, k.ID)
+		info.SentToday = sent.ToCoin()
+		infos = append(infos, info)
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].Created.After(infos[j].Created)
+	})
+	return infos
+}
+
+// authenticate returns the ID of the unrevoked key presented as a bearer
+// token in the Authorization header of r.  The returned ID is empty when no
+// key was presented.
+func (s *apiKeyStore) authenticate(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", nil
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	k, ok := s.byHash[hashAPIKey(token)]
+	if !ok || k.revoked() {
+		return "", newFaucetError(errCodeInvalidAPIKey)
+	}
+	return k.ID, nil
+}
+
+// get returns a copy of the key with the provided ID.
+func (s *apiKeyStore) get(id string) (apiKey, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, k := range s.keys {
+		if k.ID == id {
+			return *k, true
+		}
+	}
+	return apiKey{}, false
+}
+
+// recordUsage updates the usage counters of the key with a request and, when
+// amount is not zero, a payout of amount.  The counters are written to disk
+// by run and flush rather than on every request.
+func (s *apiKeyStore) recordUsage(id string, amount dcrutil.Amount) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, k := range s.keys {
+		if k.ID != id {
+			continue
+		}
+		if k.revoked() {
+			return
+		}
+		k.LastUsed = time.Now()
+		if amount == 0 {
+			k.Requests++
+		} else {
+			k.Payouts++
+			k.Sent += amount
+		}
+		s.dirty = true
+		return
+	}
+}
+
+// checkAPIKeyLimits returns an error when a payout of amount would exceed the
+// rate, daily quota or amount limit of the key.
+func checkAPIKeyLimits(k *apiKey, amount dcrutil.Amount) error {
+	if k.MaxAmount > 0 && amount > k.MaxAmount {
+		return newFaucetError(errCodeAPIKeyAmount, k.MaxAmount)
+	}
+	return checkAPIKeyBudget(k, 1, amount)
+}
+
+// checkAPIKeyBudget returns an error when n payouts totaling amount would
+// exceed the rate or daily quota of the key.
+func checkAPIKeyBudget(k *apiKey, n int, amount dcrutil.Amount) error {
+	now := time.Now()
+	if k.Rate > 0 {
+		used, _ := state.keyUsageSince(now.Add(-time.Hour), k.ID)
+		if used+n > k.Rate {
+			return newFaucetError(errCodeAPIKeyRate, k.Rate)
+		}
+	}
+	if k.DailyQuota > 0 {
+		_, sent := state.keyUsageSince(now.Add(-24*time.Hour), k.ID)
+		if sent+amount > k.DailyQuota {
+			return newFaucetError(errCodeAPIKeyQuota, k.DailyQuota)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/jrick/logrotate/rotator"
+)
+
+// Audit log decisions.
+const (
+	// decisionGranted is recorded when coins were sent.
+	decisionGranted = "granted"
+
+	// decisionRejected is recorded when the request was refused before
+	// contacting the wallet, e.g. because of the rate limit or an invalid
+	// address.
+	decisionRejected = "rejected"
+
+	// decisionFailed is recorded when the request was valid but the wallet
+	// failed to send the coins.
+	decisionFailed = "failed"
+
+	// decisionReplayed is recorded when the request repeated an earlier
+	// one with the same idempotency key and the original payout was
+	// returned instead of sending coins again.
+	decisionReplayed = "replayed"
+
+	// decisionRefilled is recorded when coins were moved from the reserve
+	// account to walletaccount.  Refill entries name the reserve account
+	// and carry the refill address instead of a requester.
+	decisionRefilled = "refilled"
+)
+
+// tokenOverride is the token name recorded when the request carried the
+// override token.
+const tokenOverride = "override"
+
+// auditEntry is a single line of the audit log.  Amounts are in DCR.
+type auditEntry struct {
+	Time             time.Time `json:"time"`
+	IP               string    `json:"ip"`
+	Address          string    `json:"address"`
+	AmountInput      string    `json:"amountinput,omitempty"`
+	AmountAtomsInput string    `json:"amountatomsinput,omitempty"`
+	Requested        float64   `json:"requested"`
+	Granted          float64   `json:"granted"`
+	Tier             string    `json:"tier,omitempty"`
+	Subject          string    `json:"subject,omitempty"`
+	APIKey           string    `json:"apikey,omitempty"`
+	Token            string    `json:"token,omitempty"`
+	IdempotencyKey   string    `json:"idempotencykey,omitempty"`
+	RequestID        string    `json:"requestid,omitempty"`
+	Purpose          string    `json:"purpose,omitempty"`
+	Reserve          string    `json:"reserve,omitempty"`
+	Simulated        bool      `json:"simulated,omitempty"`
+	Decision         string    `json:"decision"`
+	Reason           string    `json:"reason,omitempty"`
+	Code             string    `json:"code,omitempty"`
+	TxID             string    `json:"txid,omitempty"`
+}
+
+// auditLog writes audit entries as JSON lines to a log rotator.
+type auditLog struct {
+	mtx sync.Mutex
+	r   *rotator.Rotator
+}
+
+// audit is the audit log of all payout decisions.  It is initialized by
+// initAuditLog.
+var audit *auditLog
+
+// initAuditLog initializes the audit log to write to auditFile and create roll
+// files in the same directory.  Roll files are never removed.
+func initAuditLog(auditFile string) {
+	logDir, _ := filepath.Split(auditFile)
+	err := os.MkdirAll(logDir, 0700)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create log directory: %v\n", err)
+		os.Exit(1)
+	}
+	r, err := rotator.New(auditFile, 10*1024, false, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create audit file rotator: %v\n", err)
+		os.Exit(1)
+	}
+
+	audit = &auditLog{r: r}
+}
+
+// record completes entry with the outcome of the request and appends it to
+// the audit log.  The decision defaults to granted when err is nil and to
+// rejected otherwise, unless it was already set.
+func (a *auditLog) record(entry *auditEntry, requested, granted dcrutil.Amount, txid string, err error) {
+	entry.Requested = requested.ToCoin()
+	entry.Granted = granted.ToCoin()
+	entry.TxID = txid
+	if entry.Decision == "" {
+		entry.Decision = decisionGranted
+		if err != nil {
+			entry.Decision = decisionRejected
+		}
+	}
+	if err != nil {
+		entry.Reason = err.Error()
+		var fe *faucetError
+		if errors.As(err, &fe) {
+			entry.Code = fe.Code
+		}
+	}
+
+	b, jerr := json.Marshal(entry)
+	if jerr != nil {
+		log.Errorf("failed to marshal audit entry: %v", jerr)
+		return
+	}
+	b = append(b, '\n')
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.r == nil {
+		log.Errorf("audit log closed, dropping entry: %s", b[:len(b)-1])
+		return
+	}
+	if _, werr := a.r.Write(b); werr != nil {
+		log.Errorf("failed to write audit entry: %v", werr)
+	}
+}
+
+// close flushes and closes the audit log.  Entries recorded afterwards are
+// only logged.
+func (a *auditLog) close() {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.r == nil {
+		return
+	}
+	if err := a.r.Close(); err != nil {
+		log.Errorf("failed to close audit log: %v", err)
+	}
+	a.r = nil
+}
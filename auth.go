@@ -0,0 +1,467 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// authCookieName is the name of the cookie holding the login session.
+	authCookieName = "faucetauth"
+
+	// authStateCookieName is the name of the cookie binding a started
+	// login to the browser which started it.
+	authStateCookieName = "faucetlogin"
+
+	// authSessionExpiry is how long a login session lasts.
+	authSessionExpiry = 24 * time.Hour
+
+	// authLoginExpiry is how long a started login may take to complete.
+	authLoginExpiry = 10 * time.Minute
+
+	// authHTTPTimeout is the timeout of requests to the identity provider.
+	authHTTPTimeout = 30 * time.Second
+
+	// oidcProviderGitHub selects GitHub, which supports OAuth 2.0 but not
+	// OpenID Connect discovery, as the identity provider.
+	oidcProviderGitHub = "github"
+)
+
+// oidcProvider describes the endpoints of an identity provider.
+type oidcProvider struct {
+	issuer      string
+	authURL     string
+	tokenURL    string
+	userInfoURL string
+
+	// subjectField is the userinfo field holding the stable identifier of
+	// the user.
+	subjectField string
+
+	// basicAuth is set when the token endpoint does not accept client
+	// credentials in the request body.
+	basicAuth bool
+}
+
+// gitHubProvider is the provider used for oidcissuer=github.
+var gitHubProvider = oidcProvider{
+	issuer:       oidcProviderGitHub,
+	authURL:      "https://github.com/login/oauth/authorize",
+	tokenURL:     "https://github.com/login/oauth/access_token",
+	userInfoURL:  "https://api.github.com/user",
+	subjectField: "id",
+}
+
+// authSession is a logged in user.
+type authSession struct {
+	Subject string
+	Name    string
+	expires time.Time
+}
+
+// pendingLogin is a login waiting for the provider to redirect back.
+type pendingLogin struct {
+	verifier string
+	expires  time.Time
+}
+
+// authenticator logs users in with an OpenID Connect or OAuth 2.0 provider and
+// keeps their sessions in memory.
+type authenticator struct {
+	provider     *oidcProvider
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	scopes       string
+	client       *http.Client
+
+	mtx      sync.Mutex
+	sessions map[string]*authSession
+	logins   map[string]*pendingLogin
+}
+
+// auth is the authenticator of logged in users.  It is nil when login is
+// disabled.
+var auth *authenticator
+
+// newAuthenticator creates an authenticator for the configured provider,
+// discovering its endpoints unless it is GitHub.
+func newAuthenticator(ctx context.Context, cfg *config) (*authenticator, error) {
+	a := &authenticator{
+		clientID:     cfg.OIDCClientID,
+		clientSecret: cfg.OIDCClientSecret,
+		redirectURL:  cfg.OIDCRedirectURL,
+		scopes:       cfg.OIDCScopes,
+		client:       &http.Client{Timeout: authHTTPTimeout},
+		sessions:     make(map[string]*authSession),
+		logins:       make(map[string]*pendingLogin),
+	}
+	if cfg.OIDCIssuer == oidcProviderGitHub {
+		provider := gitHubProvider
+		a.provider = &provider
+		if a.scopes == "" {
+			a.scopes = "read:user"
+		}
+		return a, nil
+	}
+
+	provider, err := discoverProvider(ctx, a.client, cfg.OIDCIssuer)
+	if err != nil {
+		return nil, err
+	}
+	a.provider = provider
+	if a.scopes == "" {
+		a.scopes = "openid profile"
+	}
+	return a, nil
+}
+
+// discoverProvider fetches the OpenID Connect discovery document of issuer.
+func discoverProvider(ctx context.Context, client *http.Client, issuer string) (*oidcProvider, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Issuer           string   `json:"issuer"`
+		AuthURL          string   `json:"authorization_endpoint"`
+		TokenURL         string   `json:"token_endpoint"`
+		UserInfoURL      string   `json:"userinfo_endpoint"`
+		TokenAuthMethods []string `json:"token_endpoint_auth_methods_supported"`
+	}
+	if err := doJSON(client, req, &doc); err != nil {
+		return nil, fmt.Errorf("OIDC discovery of %s: %v", issuer, err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("OIDC discovery of %s: issuer mismatch %q",
+			issuer, doc.Issuer)
+	}
+	if doc.AuthURL == "" || doc.TokenURL == "" || doc.UserInfoURL == "" {
+		return nil, fmt.Errorf("OIDC discovery of %s: missing endpoints",
+			issuer)
+	}
+
+	p := &oidcProvider{
+		issuer:       issuer,
+		authURL:      doc.AuthURL,
+		tokenURL:     doc.TokenURL,
+		userInfoURL:  doc.UserInfoURL,
+		subjectField: "sub",
+	}
+	if len(doc.TokenAuthMethods) > 0 {
+		p.basicAuth = true
+		for _, m := range doc.TokenAuthMethods {
+			if m == "client_secret_post" {
+				p.basicAuth = false
+			}
+		}
+	}
+	return p, nil
+}
+
+// doJSON performs req and decodes the JSON reply into v.
+func doJSON(client *http.Client, req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// randomToken returns a random URL safe token.
+func randomToken() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// pruneLocked removes expired sessions and logins.  It must be called with the
+// mutex held.
+func (a *authenticator) pruneLocked() {
+	now := time.Now()
+	for id, s := range a.sessions {
+		if now.After(s.expires) {
+			delete(a.sessions, id)
+		}
+	}
+	for state, l := range a.logins {
+		if now.After(l.expires) {
+			delete(a.logins, state)
+		}
+	}
+}
+
+// session returns the logged in user of r, or nil.
+func (a *authenticator) session(r *http.Request) *authSession {
+	if a == nil {
+		return nil
+	}
+	c, err := r.Cookie(authCookieName)
+	if err != nil {
+		return nil
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	s, ok := a.sessions[c.Value]
+	if !ok || time.Now().After(s.expires) {
+		return nil
+	}
+	return s
+}
+
+// setCookie sets the session cookie.  An empty id removes it.
+func (a *authenticator) setCookie(w http.ResponseWriter, id string) {
+	maxAge := int(authSessionExpiry.Seconds())
+	if id == "" {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     authCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.redirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// setStateCookie sets the cookie holding the state of a started login.  An
+// empty state removes it.
+func (a *authenticator) setStateCookie(w http.ResponseWriter, state string) {
+	maxAge := int(authLoginExpiry.Seconds())
+	if state == "" {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     authStateCookieName,
+		Value:    state,
+		Path:     "/auth/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.redirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// handleLogin is the handler for HTTP GET requests to "/auth/login".  It
+// redirects to the identity provider using the authorization code flow with
+// PKCE.  The state is also kept in a cookie, so that only the browser which
+// started the login can complete it.
+func (a *authenticator) handleLogin(w http.ResponseWriter, r *http.Request) {
+	state, err := randomToken()
+	if err != nil {
+		authLog.Errorf("failed to create login state: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	verifier, err := randomToken()
+	if err != nil {
+		authLog.Errorf("failed to create PKCE verifier: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	a.mtx.Lock()
+	a.pruneLocked()
+	a.logins[state] = &pendingLogin{
+		verifier: verifier,
+		expires:  time.Now().Add(authLoginExpiry),
+	}
+	a.mtx.Unlock()
+
+	u, err := url.Parse(a.provider.authURL)
+	if err != nil {
+		authLog.Errorf("invalid authorization endpoint: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", a.clientID)
+	q.Set("redirect_uri", a.redirectURL)
+	q.Set("scope", a.scopes)
+	q.Set("state", state)
+	q.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	a.setStateCookie(w, state)
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// handleCallback is the handler for HTTP GET requests to "/auth/callback".  It
+// completes the login started by handleLogin and creates the session.
+func (a *authenticator) handleCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	state := q.Get("state")
+	c, err := r.Cookie(authStateCookieName)
+	a.setStateCookie(w, "")
+	if e := q.Get("error"); e != "" {
+		authLog.Infof("login failed: %s: %s", e, q.Get("error_description"))
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if err != nil || state == "" ||
+		subtle.ConstantTimeCompare([]byte(c.Value), []byte(state)) != 1 {
+
+		authLog.Infof("login state does not match the browser")
+		http.Error(w, "invalid or expired login", http.StatusBadRequest)
+		return
+	}
+
+	a.mtx.Lock()
+	login, ok := a.logins[state]
+	delete(a.logins, state)
+	a.mtx.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		http.Error(w, "invalid or expired login", http.StatusBadRequest)
+		return
+	}
+
+	token, err := a.exchange(r.Context(), q.Get("code"), login.verifier)
+	if err != nil {
+		authLog.Errorf("failed to exchange authorization code: %v", err)
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+	session, err := a.userInfo(r.Context(), token)
+	if err != nil {
+		authLog.Errorf("failed to fetch user info: %v", err)
+		http.Error(w, "login failed", http.StatusBadGateway)
+		return
+	}
+
+	id, err := randomToken()
+	if err != nil {
+		authLog.Errorf("failed to create session id: %v", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	session.expires = time.Now().Add(authSessionExpiry)
+	a.mtx.Lock()
+	a.pruneLocked()
+	a.sessions[id] = session
+	a.mtx.Unlock()
+
+	authLog.Infof("%s logged in (subject %s)", session.Name, session.Subject)
+	a.setCookie(w, id)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// handleLogout is the handler for HTTP POST requests to "/auth/logout".
+func (a *authenticator) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(authCookieName); err == nil {
+		a.mtx.Lock()
+		delete(a.sessions, c.Value)
+		a.mtx.Unlock()
+	}
+	a.setCookie(w, "")
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// exchange redeems an authorization code for an access token.
+func (a *authenticator) exchange(ctx context.Context, code, verifier string) (string, error) {
+	if code == "" {
+		return "", errors.New("missing authorization code")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {a.redirectURL},
+		"code_verifier": {verifier},
+	}
+	if !a.provider.basicAuth {
+		form.Set("client_id", a.clientID)
+		form.Set("client_secret", a.clientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		a.provider.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if a.provider.basicAuth {
+		req.SetBasicAuth(url.QueryEscape(a.clientID),
+			url.QueryEscape(a.clientSecret))
+	}
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := doJSON(a.client, req, &resp); err != nil {
+		return "", err
+	}
+	if resp.AccessToken == "" {
+		return "", fmt.Errorf("no access token: %s", resp.Error)
+	}
+	return resp.AccessToken, nil
+}
+
+// userInfo fetches the identity of the user owning the access token.
+func (a *authenticator) userInfo(ctx context.Context, token string) (*authSession, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		a.provider.userInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	var info map[string]interface{}
+	if err := doJSON(a.client, req, &info); err != nil {
+		return nil, err
+	}
+	subject, ok := info[a.provider.subjectField]
+	if !ok || fmt.Sprint(subject) == "" {
+		return nil, fmt.Errorf("user info lacks %q", a.provider.subjectField)
+	}
+
+	s := &authSession{
+		Subject: a.provider.issuer + "|" + fmt.Sprint(subject),
+	}
+	for _, field := range []string{"preferred_username", "login", "name", "email"} {
+		if v, ok := info[field].(string); ok && v != "" {
+			s.Name = v
+			break
+		}
+	}
+	if s.Name == "" {
+		s.Name = fmt.Sprint(subject)
+	}
+	return s, nil
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/decred/slog"
+)
+
+// mockIssuer is an OpenID Connect provider which authorizes every login
+// immediately.
+type mockIssuer struct {
+	*httptest.Server
+
+	mtx        sync.Mutex
+	challenges map[string]string // code -> PKCE challenge
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	m := &mockIssuer{challenges: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/authorize",
+			"token_endpoint":                        m.URL + "/token",
+			"userinfo_endpoint":                     m.URL + "/userinfo",
+			"token_endpoint_auth_methods_supported": []string{"client_secret_post"},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.PostForm.Get("client_id") != "faucet" ||
+			r.PostForm.Get("client_secret") != "secret" {
+
+			http.Error(w, "invalid client", http.StatusUnauthorized)
+			return
+		}
+		m.mtx.Lock()
+		challenge, ok := m.challenges[r.PostForm.Get("code")]
+		delete(m.challenges, r.PostForm.Get("code"))
+		m.mtx.Unlock()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			http.Error(w, "invalid grant", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "token",
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"sub":                "alice-id",
+			"preferred_username": "alice",
+		})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// authorize approves the login redirected to the authorization endpoint and
+// returns the code.
+func (m *mockIssuer) authorize(t *testing.T, authURL *url.URL) string {
+	t.Helper()
+
+	q := authURL.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("login does not use PKCE: %v", authURL)
+	}
+	code := "code-" + q.Get("state")
+	m.mtx.Lock()
+	m.challenges[code] = q.Get("code_challenge")
+	m.mtx.Unlock()
+	return code
+}
+
+// startLogin starts a login and returns the authorization URL and the cookies
+// set on the browser.
+func startLogin(t *testing.T, a *authenticator) (*url.URL, []*http.Cookie) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	a.handleLogin(w, httptest.NewRequest(http.MethodGet, "/auth/login", nil))
+	resp := w.Result()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("login status %d", resp.StatusCode)
+	}
+	u, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, resp.Cookies()
+}
+
+// callback completes a login in a browser holding cookies.
+func callback(a *authenticator, state, code string, cookies []*http.Cookie) *http.Response {
+	q := url.Values{"state": {state}, "code": {code}}
+	r := httptest.NewRequest(http.MethodGet, "/auth/callback?"+q.Encode(), nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	a.handleCallback(w, r)
+	return w.Result()
+}
+
+func TestAuthLogin(t *testing.T) {
+	authLog.SetLevel(slog.LevelOff)
+	issuer := newMockIssuer(t)
+
+	a, err := newAuthenticator(context.Background(), &config{
+		OIDCIssuer:       issuer.URL,
+		OIDCClientID:     "faucet",
+		OIDCClientSecret: "secret",
+		OIDCRedirectURL:  "http://127.0.0.1:8000/auth/callback",
+	})
+	if err != nil {
+		t.Fatalf("discovery failed: %v", err)
+	}
+	if a.provider.tokenURL != issuer.URL+"/token" {
+		t.Fatalf("discovered token endpoint %q", a.provider.tokenURL)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		authURL, cookies := startLogin(t, a)
+		code := issuer.authorize(t, authURL)
+		resp := callback(a, authURL.Query().Get("state"), code, cookies)
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("callback status %d", resp.StatusCode)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for _, c := range resp.Cookies() {
+			if c.Name == authCookieName {
+				r.AddCookie(c)
+			}
+		}
+		s := a.session(r)
+		if s == nil {
+			t.Fatal("no session after login")
+		}
+		if want := issuer.URL + "|alice-id"; s.Subject != want {
+			t.Fatalf("subject %q, want %q", s.Subject, want)
+		}
+		if s.Name != "alice" {
+			t.Fatalf("name %q, want alice", s.Name)
+		}
+	})
+
+	t.Run("other browser", func(t *testing.T) {
+		authURL, _ := startLogin(t, a)
+		code := issuer.authorize(t, authURL)
+		resp := callback(a, authURL.Query().Get("state"), code, nil)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("callback without state cookie: status %d",
+				resp.StatusCode)
+		}
+
+		// The state of another login is refused as well.
+		authURL, _ = startLogin(t, a)
+		_, cookies := startLogin(t, a)
+		code = issuer.authorize(t, authURL)
+		resp = callback(a, authURL.Query().Get("state"), code, cookies)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("callback with other state cookie: status %d",
+				resp.StatusCode)
+		}
+	})
+
+	t.Run("unknown code", func(t *testing.T) {
+		authURL, cookies := startLogin(t, a)
+		issuer.authorize(t, authURL)
+		resp := callback(a, authURL.Query().Get("state"), "unknown",
+			cookies)
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Fatalf("callback with unknown code: status %d",
+				resp.StatusCode)
+		}
+	})
+}
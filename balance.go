@@ -0,0 +1,229 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/decred/dcrd/dcrjson/v4"
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/decred/dcrd/rpcclient/v8"
+)
+
+// bestBlockPollInterval is how often the best block of the primary wallet is
+// polled.  The balance is refreshed whenever a new block is found.
+const bestBlockPollInterval = 5 * time.Second
+
+// balanceFallbackInterval is how often the balance is refreshed regardless of
+// new blocks.  It covers unconfirmed transactions received between blocks.
+const balanceFallbackInterval = time.Minute
+
+// walletBalance is the balance breakdown of the faucet account as reported by
+// a wallet, or the sum across all wallets.  Spendable only includes confirmed
+// outputs.
+type walletBalance struct {
+	Spendable       dcrutil.Amount
+	Unconfirmed     dcrutil.Amount
+	Immature        dcrutil.Amount
+	LockedByTickets dcrutil.Amount
+	VotingAuthority dcrutil.Amount
+	Total           dcrutil.Amount
+}
+
+// available returns the amount which can be used for payouts.  Payouts are
+// sent with a minimum of zero confirmations, so unconfirmed outputs may be
+// spent as well.
+func (b *walletBalance) available() dcrutil.Amount {
+	return b.Spendable + b.Unconfirmed
+}
+
+// add adds the balance breakdown of another wallet.
+func (b *walletBalance) add(o *walletBalance) {
+	b.Spendable += o.Spendable
+	b.Unconfirmed += o.Unconfirmed
+	b.Immature += o.Immature
+	b.LockedByTickets += o.LockedByTickets
+	b.VotingAuthority += o.VotingAuthority
+	b.Total += o.Total
+}
+
+// status returns the balance breakdown in DCR as reported by the status API.
+func (b *walletBalance) status() balanceStatus {
+	return balanceStatus{
+		Available:       b.available().ToCoin(),
+		Spendable:       b.Spendable.ToCoin(),
+		Unconfirmed:     b.Unconfirmed.ToCoin(),
+		Immature:        b.Immature.ToCoin(),
+		LockedByTickets: b.LockedByTickets.ToCoin(),
+		VotingAuthority: b.VotingAuthority.ToCoin(),
+		Total:           b.Total.ToCoin(),
+	}
+}
+
+// balanceUpdates is used to request a balance refresh from the balance
+// updater.  It is buffered so that bursts of requests which arrive while
+// an update is already pending are coalesced into a single update.
+var balanceUpdates = make(chan struct{}, 1)
+
+// requestBalanceUpdate schedules a balance refresh without blocking.
+func requestBalanceUpdate() {
+	select {
+	case balanceUpdates <- struct{}{}:
+	default:
+	}
+}
+
+// connectHandlers returns the rpcclient handlers which refresh the balance
+// whenever the connection to a wallet is established.
+func connectHandlers() *rpcclient.NotificationHandlers {
+	return &rpcclient.NotificationHandlers{
+		OnClientConnected: func() {
+			log.Debugf("Connected to dcrwallet, refreshing balance")
+			requestBalanceUpdate()
+		},
+	}
+}
+
+// pollBestBlock requests a balance update whenever the best block of the
+// primary wallet changes until quit is closed.  dcrwallet does not deliver
+// block or transaction notifications to JSON-RPC clients, so the best block is
+// polled instead.
+func pollBestBlock(quit <-chan struct{}) {
+	ticker := time.NewTicker(bestBlockPollInterval)
+	defer ticker.Stop()
+
+	var last string
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+
+		w := wallets.backends[0]
+		if w.rpc.Disconnected() {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(),
+			bestBlockPollInterval)
+		var hash string
+		err := w.client.Call(ctx, "getbestblockhash", &hash)
+		cancel()
+		if err != nil {
+			log.Debugf("Unable to get the best block of wallet %s: %v",
+				w, err)
+			continue
+		}
+		if hash != last {
+			if last != "" {
+				log.Tracef("New best block %s, refreshing balance", hash)
+				requestBalanceUpdate()
+			}
+			last = hash
+		}
+	}
+}
+
+// balanceUpdater refreshes the balance and the returned coins when requested
+// through requestBalanceUpdate, such as on new blocks, and every
+// balanceFallbackInterval until quit is closed.
+func balanceUpdater(quit <-chan struct{}) {
+	ticker := time.NewTicker(balanceFallbackInterval)
+	defer ticker.Stop()
+
+	update := func() {
+		updateBalance()
+		returns.refresh(context.Background())
+	}
+
+	update()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-balanceUpdates:
+			update()
+		case <-ticker.C:
+			update()
+		}
+	}
+}
+
+// updateBalance refreshes the balance of every wallet.  The reported balance
+// is the sum across the wallets which could be reached, while the transaction
+// limit follows the largest balance of a single wallet since every payout is
+// sent from one wallet.  The primary wallet is refilled from the reserve
+// account when its balance is low.
+func updateBalance() {
+	// Use background context here, rather than a request context, because
+	// updateBalance should always succeed after a payout, even if the request
+	// context has been closed (eg. because client has closed their connection).
+	var balance, largest walletBalance
+	var reached int
+	for i, w := range wallets.backends {
+		b, err := w.fetchBalance(context.Background())
+		if err != nil {
+			log.Warnf("unable to update balance of wallet %s: %v", w, err)
+			continue
+		}
+		if i == 0 && cfg.ReserveAccount != "" && !cfg.DryRun {
+			go refill(context.Background(), w, b.available())
+		}
+		reached++
+		balance.add(&b)
+		if b.available() > largest.available() {
+			largest = b
+		}
+	}
+	if reached == 0 {
+		return
+	}
+
+	amountMtx.Lock()
+	log.Infof("updating balance from %v to %v (confirmed %v, unconfirmed %v, "+
+		"immature %v, locked by tickets %v, voting authority %v)",
+		lastBalance.available(), balance.available(), balance.Spendable,
+		balance.Unconfirmed, balance.Immature, balance.LockedByTickets,
+		balance.VotingAuthority)
+	lastBalance = balance
+	transactionLimit = cfg.limitPolicy.limit(largest.available())
+	log.Infof("updating transaction limit to %v", transactionLimit)
+	amountMtx.Unlock()
+
+	history.recordBalance(balance.available())
+	events.publish(eventBalance, currentBalanceEvent())
+}
+
+// isInsufficientFundsError returns whether err is the wallet's insufficient
+// funds RPC error.
+func isInsufficientFundsError(err error) bool {
+	var rpcErr *dcrjson.RPCError
+	return errors.As(err, &rpcErr) &&
+		rpcErr.Code == dcrjson.ErrRPCWalletInsufficientFunds
+}
+
+// insufficientFundsError returns an error explaining why a payout of amount
+// spending outputs with at least minConf confirmations could not be funded,
+// based on the most recent balance.  The payout only awaits confirmations when
+// it required confirmed outputs and the unconfirmed balance would cover it.
+func insufficientFundsError(amount dcrutil.Amount, minConf int) error {
+	amountMtx.RLock()
+	balance := lastBalance
+	amountMtx.RUnlock()
+
+	if minConf > 0 && balance.Spendable < amount &&
+		balance.available() >= amount {
+
+		return newFaucetError(errCodeAwaitingConfirmation,
+			balance.Unconfirmed)
+	}
+	if balance.Immature > 0 || balance.LockedByTickets > 0 {
+		return newFaucetError(errCodeFundsLocked, amount,
+			balance.Immature, balance.LockedByTickets)
+	}
+	return newFaucetError(errCodeInsufficientFunds, amount)
+}
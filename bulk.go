@@ -0,0 +1,540 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/decred/dcrd/txscript/v4/stdaddr"
+)
+
+// bulkTierName is the tier recorded for payouts of bulk requests.  Bulk
+// requests are limited by their API key rather than by a payout tier.
+const bulkTierName = "bulk"
+
+// maxBulkRecipients is the maximum number of recipients of a bulk request.
+const maxBulkRecipients = 50
+
+// maxBulkBodySize is the maximum size in bytes of the body of a bulk request.
+const maxBulkBodySize = 64 * 1024
+
+// Outcomes of a single recipient of a bulk request.
+const (
+	bulkPaid     = "paid"
+	bulkRejected = "rejected"
+	bulkFailed   = "failed"
+
+	// bulkReplayed marks recipients paid by an earlier request with the
+	// same idempotency key.  They are reported as paid.
+	bulkReplayed = "replayed"
+)
+
+// bulkRecipient is a recipient of a bulk request.  The amount is given either
+// in DCR or in atoms, and defaults to the amount of the first payout tier.
+type bulkRecipient struct {
+	Address     string `json:"address"`
+	Amount      string `json:"amount,omitempty"`
+	AmountAtoms string `json:"amount_atoms,omitempty"`
+}
+
+// bulkRequest is the JSON body of a bulk request.
+type bulkRequest struct {
+	Recipients []bulkRecipient `json:"recipients"`
+	Purpose    string          `json:"purpose,omitempty"`
+}
+
+// bulkResult is the outcome of a single recipient of a bulk request.  Amount
+// is in DCR.
+type bulkResult struct {
+	Address string  `json:"address"`
+	Amount  float64 `json:"amount,omitempty"`
+	Status  string  `json:"status"`
+	Error   string  `json:"error,omitempty"`
+	Code    string  `json:"code,omitempty"`
+
+	err error
+}
+
+// bulkResponse is the reply to a bulk request.  Amounts are in DCR.
+type bulkResponse struct {
+	RequestID  string       `json:"requestid"`
+	TxID       string       `json:"txid,omitempty"`
+	Total      float64      `json:"total"`
+	Fee        float64      `json:"fee"`
+	Simulated  bool         `json:"simulated,omitempty"`
+	Recipients []bulkResult `json:"recipients"`
+	Error      string       `json:"error,omitempty"`
+	Code       string       `json:"code,omitempty"`
+}
+
+// requestBulk is the handler for HTTP POST requests to "/requestfaucet/bulk".
+// It pays every valid recipient of the request in a single transaction.  Bulk
+// requests must be authenticated with an API key.  Like single payouts, they
+// are checked right away and then sent by the payout queue.  Clients setting
+// async=true are answered with 202 Accepted as soon as the request is queued.
+func requestBulk(w http.ResponseWriter, r *http.Request) {
+	hostIP, err := getClientIP(r)
+	if err != nil {
+		panic(err)
+	}
+
+	id, err := apiKeys.authenticate(r)
+	if err == nil && id == "" {
+		err = newFaucetError(errCodeAPIKeyRequired)
+	}
+	if err != nil {
+		log.Debugf("ip %v made a bulk request without a valid API key",
+			hostIP)
+		writeJSONError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	var body bulkRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxBulkBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		log.Debugf("ip %v sent a malformed bulk request: %v", hostIP, err)
+		writeJSONError(w, r, http.StatusBadRequest,
+			newFaucetError(errCodeBadRequest))
+		return
+	}
+	switch n := len(body.Recipients); {
+	case n == 0:
+		writeJSONError(w, r, http.StatusBadRequest,
+			newFaucetError(errCodeBulkEmpty))
+		return
+	case n > maxBulkRecipients:
+		writeJSONError(w, r, http.StatusBadRequest,
+			newFaucetError(errCodeBulkTooMany, maxBulkRecipients))
+		return
+	}
+
+	req := &payRequest{
+		hostIP:         hostIP,
+		apiKey:         id,
+		purpose:        strings.TrimSpace(body.Purpose),
+		idempotencyKey: r.Header.Get(idempotencyKeyHeader),
+		recipients:     body.Recipients,
+	}
+	lang := requestLanguage(r)
+
+	// Refuse requests which cannot be paid before they are queued.
+	if _, err := checkBulk(req); err != nil {
+		writeJSON(w, http.StatusOK, rejectBulk(req, err).localized(err, lang))
+		return
+	}
+	apiKeys.recordUsage(id, 0)
+	job, err := payouts.submit(req, "")
+	if err != nil {
+		writeJSON(w, http.StatusOK, rejectBulk(req, err).localized(err, lang))
+		return
+	}
+
+	if r.FormValue("async") != "" {
+		w.Header().Set("Location", "/requeststatus/"+job.id)
+		writeJSON(w, http.StatusAccepted, payouts.jobStatus(job, lang))
+		return
+	}
+	select {
+	case <-job.done:
+	case <-r.Context().Done():
+		return
+	}
+	writeJSON(w, http.StatusOK, payouts.bulkResult(job, lang))
+}
+
+// checkBulk returns the API key paying a bulk request, or an error explaining
+// why the request is refused.  It is checked before the request is queued and
+// again when it is paid.  Requests repeating the idempotency key of an earlier
+// one pass without a key, since they are answered with the original payouts.
+func checkBulk(req *payRequest) (*apiKey, error) {
+	if len(req.idempotencyKey) > maxIdempotencyKeyLen {
+		return nil, newFaucetError(errCodeIdempotencyKeyLength,
+			maxIdempotencyKeyLen)
+	}
+	if err := validatePurpose(req.purpose); err != nil {
+		return nil, err
+	}
+	if req.idempotencyKey != "" &&
+		len(state.payoutsByIdempotencyKey(req.idempotencyScope())) > 0 {
+
+		return nil, nil
+	}
+	if state.isPaused() {
+		return nil, newFaucetError(errCodePaused)
+	}
+	key, ok := apiKeys.get(req.apiKey)
+	if !ok || key.revoked() {
+		return nil, newFaucetError(errCodeInvalidAPIKey)
+	}
+
+	// Bulk requests may pay many recipients at once, so they are only
+	// served for keys limited by a daily quota.
+	if key.DailyQuota <= 0 {
+		return nil, newFaucetError(errCodeBulkRequiresQuota)
+	}
+	return &key, nil
+}
+
+// newBulkResponse returns the reply to the bulk request req, with no outcome
+// for any recipient yet.
+func newBulkResponse(req *payRequest) *bulkResponse {
+	resp := &bulkResponse{
+		RequestID:  req.requestID,
+		Recipients: make([]bulkResult, len(req.recipients)),
+	}
+	for i, rc := range req.recipients {
+		resp.Recipients[i].Address = rc.Address
+	}
+	return resp
+}
+
+// bulkAuditEntries returns the audit entries of the recipients of the bulk
+// request req.
+func bulkAuditEntries(req *payRequest) []*auditEntry {
+	entries := make([]*auditEntry, len(req.recipients))
+	for i, rc := range req.recipients {
+		entries[i] = &auditEntry{
+			Time:             time.Now(),
+			IP:               req.hostIP,
+			Address:          rc.Address,
+			AmountInput:      rc.Amount,
+			AmountAtomsInput: rc.AmountAtoms,
+			Tier:             bulkTierName,
+			APIKey:           req.apiKey,
+			IdempotencyKey:   req.idempotencyKey,
+			RequestID:        req.requestID,
+			Purpose:          req.purpose,
+		}
+	}
+	return entries
+}
+
+// rejectBulk records the refusal of every recipient of the bulk request req in
+// the audit log and returns the reply.
+func rejectBulk(req *payRequest, err error) *bulkResponse {
+	resp := newBulkResponse(req)
+	for i, entry := range bulkAuditEntries(req) {
+		resp.Recipients[i].Status = bulkRejected
+		resp.Recipients[i].err = err
+		audit.record(entry, 0, 0, "", err)
+	}
+	return resp
+}
+
+// localized returns a copy of resp with err, the error of the request, and the
+// errors of the recipients described in lang.
+func (resp *bulkResponse) localized(err error, lang string) *bulkResponse {
+	if resp == nil {
+		return nil
+	}
+	l := *resp
+	l.Recipients = append([]bulkResult(nil), resp.Recipients...)
+	if err != nil {
+		l.Code, l.Error = localizeError(err, lang)
+	}
+	for i := range l.Recipients {
+		res := &l.Recipients[i]
+		if res.err != nil {
+			res.Code, res.Error = localizeError(res.err, lang)
+		}
+	}
+	return &l
+}
+
+// payBulk validates every recipient and pays the valid ones in a single
+// transaction.  Recipients are refused individually, while limits of the API
+// key and the faucet apply to the request as a whole.  A request repeating the
+// idempotency key of an earlier one returns the original payouts instead of
+// paying again.  Every recipient is recorded in the audit log.  It is called
+// by the payout queue.
+func payBulk(ctx context.Context, req *payRequest) (*bulkResponse, error) {
+	recipients := req.recipients
+	resp := newBulkResponse(req)
+	entries := bulkAuditEntries(req)
+	amounts := make([]dcrutil.Amount, len(recipients))
+
+	// Record the outcome of every recipient in the audit log.  Recipients
+	// without an outcome share the error of the request.
+	var txid string
+	var reqErr error
+	defer func() {
+		for i, res := range resp.Recipients {
+			var granted dcrutil.Amount
+			err := res.err
+			switch res.Status {
+			case bulkPaid:
+				granted = amounts[i]
+			case bulkFailed:
+				entries[i].Decision = decisionFailed
+			case bulkReplayed:
+				resp.Recipients[i].Status = bulkPaid
+				entries[i].Decision = decisionReplayed
+				granted = amounts[i]
+			case "":
+				resp.Recipients[i].Status = bulkRejected
+				resp.Recipients[i].err = reqErr
+				err = reqErr
+			}
+			entries[i].Simulated = cfg.DryRun && res.Status == bulkPaid
+			audit.record(entries[i], amounts[i], granted, txid, err)
+		}
+	}()
+	fail := func(err error) (*bulkResponse, error) {
+		reqErr = err
+		return resp, err
+	}
+
+	requestMtx.Lock()
+	defer requestMtx.Unlock()
+
+	// Return the original payouts of a repeated request rather than
+	// paying again.
+	if req.idempotencyKey != "" {
+		prev := state.payoutsByIdempotencyKey(req.idempotencyScope())
+		if len(prev) > 0 {
+			txid = prev[0].TxID
+			err := replayBulk(resp, amounts, recipients, prev)
+			if err != nil {
+				return fail(err)
+			}
+			log.Infof("replaying bulk request %v for %v (idempotency "+
+				"key %q)", prev[0].RequestID, req.hostIP,
+				req.idempotencyKey)
+			return resp, nil
+		}
+	}
+
+	key, err := checkBulk(req)
+	if err != nil {
+		return fail(err)
+	}
+
+	amountMtx.RLock()
+	tLimit := transactionLimit
+	amountMtx.RUnlock()
+	defaultAmount := effectiveAmount(cfg.payoutTiers[0], tLimit)
+	if key.MaxAmount > 0 {
+		defaultAmount = minAmount(defaultAmount, key.MaxAmount)
+	}
+
+	// Validate every recipient on its own.
+	var payments []payment
+	var paid []int
+	var total dcrutil.Amount
+	seen := make(map[string]bool, len(recipients))
+	for i, rc := range recipients {
+		addr, amount, err := validateBulkRecipient(ctx, key, rc,
+			defaultAmount, seen)
+		amounts[i] = amount
+		if err != nil {
+			resp.Recipients[i].Status = bulkRejected
+			resp.Recipients[i].err = err
+			continue
+		}
+		resp.Recipients[i].Amount = amount.ToCoin()
+		payments = append(payments, payment{addr, amount})
+		paid = append(paid, i)
+		total += amount
+	}
+	if len(payments) == 0 {
+		return fail(newFaucetError(errCodeBulkNoRecipients))
+	}
+
+	// The budget of the key and the transaction limit apply to all
+	// payments together.
+	if err := checkAPIKeyBudget(key, len(payments), total); err != nil {
+		log.Debugf("API key %s exceeded its limits: %v", key.ID, err)
+		return fail(err)
+	}
+	if total > tLimit {
+		return fail(newFaucetError(errCodeAmountExceedsLimit))
+	}
+
+	minConf := 0
+	if cfg.UTXOPoolSize > 0 {
+		minConf = 1
+	}
+	memo := payoutMemo(req)
+	hash, wallet, fee, err := wallets.sendMany(ctx, payments, minConf, memo)
+	if minConf > 0 && isInsufficientFundsError(err) {
+		minConf = 0
+		hash, wallet, fee, err = wallets.sendMany(ctx, payments,
+			minConf, memo)
+	}
+	if err != nil {
+		log.Errorf("error sending bulk request %v of %v to %d recipients "+
+			"for %v: %v", req.requestID, total, len(payments),
+			req.hostIP, err)
+		switch {
+		case errors.Is(err, errNoWallet):
+		case isInsufficientFundsError(err):
+			updateBalance()
+			err = insufficientFundsError(total, minConf)
+		default:
+			err = newFaucetError(errCodePayoutFailed, err)
+		}
+		for _, i := range paid {
+			resp.Recipients[i].Status = bulkFailed
+			resp.Recipients[i].err = err
+		}
+		return fail(err)
+	}
+
+	txid = hash.String()
+	resp.TxID = txid
+	resp.Total = total.ToCoin()
+	resp.Fee = fee.ToCoin()
+	resp.Simulated = cfg.DryRun
+	if cfg.DryRun {
+		log.Infof("simulated bulk request %v of %v to %d recipients for "+
+			"%v from wallet %v (fee %v)", req.requestID, total,
+			len(payments), req.hostIP, wallet, fee)
+	} else {
+		recordFee(fee)
+		log.Infof("successfully sent bulk request %v of %v to %d "+
+			"recipients for %v from wallet %v (fee %v)", req.requestID,
+			total, len(payments), req.hostIP, wallet, fee)
+	}
+
+	now := time.Now()
+	for n, i := range paid {
+		resp.Recipients[i].Status = bulkPaid
+		p := payoutRecord{
+			TxID:      txid,
+			Time:      now,
+			IP:        req.hostIP,
+			Address:   recipients[i].Address,
+			Amount:    amounts[i],
+			Tier:      bulkTierName,
+			APIKey:    req.apiKey,
+			Wallet:    wallet.String(),
+			RequestID: req.requestID,
+			Purpose:   req.purpose,
+			Simulated: cfg.DryRun,
+
+			IdempotencyKey: req.idempotencyKey,
+		}
+		// The fee of the shared transaction is recorded only once.
+		if n == 0 {
+			p.Fee = fee
+		}
+		if err := state.addPayout(p); err != nil {
+			// The coins were sent, so only log the failure.
+			log.Errorf("failed to record payout %v to %v: %v", txid,
+				p.Address, err)
+		}
+		if !cfg.DryRun {
+			apiKeys.recordUsage(key.ID, amounts[i])
+		}
+		history.addPayout(now, amounts[i])
+		publishPayout(txid, amounts[i], p.Address, bulkTierName)
+	}
+	updateBalance()
+
+	return resp, nil
+}
+
+// replayBulk fills resp with the payouts prev made by an earlier request with
+// the same idempotency key.  An error is returned when the key was used for a
+// request with different recipients.
+func replayBulk(resp *bulkResponse, amounts []dcrutil.Amount, recipients []bulkRecipient, prev []payoutRecord) error {
+	if prev[0].Tier != bulkTierName {
+		return newFaucetError(errCodeIdempotencyKeyReused,
+			prev[0].IdempotencyKey)
+	}
+	byAddress := make(map[string]*payoutRecord, len(prev))
+	for i := range prev {
+		byAddress[prev[i].Address] = &prev[i]
+	}
+	var total dcrutil.Amount
+	for i, rc := range recipients {
+		p, ok := byAddress[rc.Address]
+		if !ok {
+			resp.Recipients[i].Status = bulkRejected
+			resp.Recipients[i].err = newFaucetError(errCodeBulkNotPaid,
+				rc.Address)
+			continue
+		}
+		amount, err := parseAmountInputs(rc.Amount, rc.AmountAtoms)
+		if err != nil || (amount != 0 && amount != p.Amount) {
+			return newFaucetError(errCodeIdempotencyKeyReused,
+				p.IdempotencyKey)
+		}
+		delete(byAddress, rc.Address)
+		amounts[i] = p.Amount
+		total += p.Amount
+		resp.Recipients[i].Amount = p.Amount.ToCoin()
+		resp.Recipients[i].Status = bulkReplayed
+	}
+	if len(byAddress) > 0 {
+		return newFaucetError(errCodeIdempotencyKeyReused,
+			prev[0].IdempotencyKey)
+	}
+
+	var fee dcrutil.Amount
+	for _, p := range prev {
+		fee += p.Fee
+	}
+	resp.RequestID = prev[0].RequestID
+	resp.TxID = prev[0].TxID
+	resp.Total = total.ToCoin()
+	resp.Fee = fee.ToCoin()
+	resp.Simulated = prev[0].Simulated
+	return nil
+}
+
+// validateBulkRecipient returns the decoded address and amount of a bulk
+// recipient, or an error explaining why it is refused.  Recipients without an
+// amount receive defaultAmount.  Keys without a maximum amount may request at
+// most the amount of the first payout tier per recipient.  seen holds the
+// addresses of earlier recipients, since each address may only be paid once
+// per transaction.
+func validateBulkRecipient(ctx context.Context, key *apiKey, rc bulkRecipient,
+	defaultAmount dcrutil.Amount, seen map[string]bool) (stdaddr.Address, dcrutil.Amount, error) {
+
+	amount, err := parseAmountInputs(rc.Amount, rc.AmountAtoms)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rc.Amount == "" && rc.AmountAtoms == "" {
+		amount = defaultAmount
+	}
+	if amount <= 0 {
+		return nil, amount, newFaucetError(errCodeAmountNotPositive)
+	}
+	if key.MaxAmount > 0 && amount > key.MaxAmount {
+		return nil, amount, newFaucetError(errCodeAPIKeyAmount,
+			key.MaxAmount)
+	}
+	if tier := cfg.payoutTiers[0]; key.MaxAmount <= 0 && amount > tier.Amount {
+		return nil, amount, newFaucetError(errCodeAmountExceedsTier,
+			tier.Amount, tier.Name)
+	}
+
+	if state.isBlocked(rc.Address) {
+		return nil, amount, newFaucetError(errCodeAddressBlocked,
+			rc.Address)
+	}
+	addr, err := stdaddr.DecodeAddress(rc.Address, activeNetParams.Params)
+	if err != nil {
+		return nil, amount, newFaucetError(errCodeInvalidAddress,
+			rc.Address)
+	}
+	if seen[addr.String()] {
+		return nil, amount, newFaucetError(errCodeDuplicateRecipient,
+			rc.Address)
+	}
+	if err := checkAddressPolicy(ctx, addr, false); err != nil {
+		return nil, amount, err
+	}
+	seen[addr.String()] = true
+	return addr, amount, nil
+}
@@ -0,0 +1,397 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// testnetfaucetctl is a command line tool to inspect and edit the state of a
+// testnetfaucet instance through its admin API.  Payout history can also be
+// read directly from the data directory of a faucet with --offline.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+	flags "github.com/jessevdk/go-flags"
+)
+
+const (
+	defaultAdminURL = "http://127.0.0.1:8001"
+
+	// payoutsFilename is the name of the payout history file in the faucet
+	// data directory.
+	payoutsFilename = "payouts.jsonl"
+)
+
+var defaultDataDir = filepath.Join(dcrutil.AppDataDir("testnetfaucet", false),
+	"data", "testnet3")
+
+// options defines the command line options of testnetfaucetctl.
+type options struct {
+	AdminURL   string  `short:"u" long:"adminurl" description:"URL of the faucet admin API"`
+	AdminToken string  `short:"t" long:"admintoken" description:"Admin API bearer token"`
+	Offline    bool    `long:"offline" description:"Read the payout history from the data directory instead of the admin API (read-only)"`
+	DataDir    string  `short:"b" long:"datadir" description:"Faucet data directory used with --offline"`
+	IP         string  `long:"ip" description:"Only list payouts to this client IP"`
+	Address    string  `long:"address" description:"Only list payouts to this address"`
+	Since      string  `long:"since" description:"Only list payouts at or after this date (2006-01-02 or RFC3339)"`
+	Until      string  `long:"until" description:"Only list payouts before this date (2006-01-02 or RFC3339)"`
+	Limit      int     `long:"limit" description:"Maximum number of payouts to list (0 lists all)"`
+	Format     string  `long:"format" description:"Output format of export {csv, json}"`
+	Quota      float64 `long:"quota" description:"Daily quota in DCR of a created API key (0 is unlimited)"`
+	Rate       int     `long:"rate" description:"Maximum payouts per hour of a created API key (0 is unlimited)"`
+	MaxAmount  float64 `long:"maxamount" description:"Maximum amount in DCR per payout of a created API key (0 uses the tier limits)"`
+	Subject    string  `long:"subject" description:"Clear the cooldowns of this logged in user, as shown in the subject of payouts, with clearcooldown"`
+}
+
+const usage = `[options] <command> [args]
+
+Commands:
+  status                 Show the balance breakdown and limits
+  payouts                List payouts matching the filter options
+  export                 Export payouts matching the filter options
+  blocked                List blocked addresses
+  block <address>        Block payouts to an address
+  unblock <address>      Unblock payouts to an address
+  clearcooldown [ip]     Clear the cooldown of an IP, of the user given by
+                         --subject, or of all clients
+  pause                  Suspend payouts
+  resume                 Resume payouts
+  apikeys                List API keys with their limits and usage
+  createkey <name>       Create an API key limited by --quota, --rate and --maxamount
+  revokekey <id>         Revoke an API key`
+
+// payoutRecord mirrors the payout records of the faucet.  Amount is in atoms.
+type payoutRecord struct {
+	TxID    string         `json:"txid"`
+	Time    time.Time      `json:"time"`
+	IP      string         `json:"ip"`
+	Address string         `json:"address"`
+	Amount  dcrutil.Amount `json:"amount"`
+	Tier    string         `json:"tier,omitempty"`
+	Token   string         `json:"token,omitempty"`
+
+	Subject        string         `json:"subject,omitempty"`
+	IdempotencyKey string         `json:"idempotencykey,omitempty"`
+	APIKey         string         `json:"apikey,omitempty"`
+	Wallet         string         `json:"wallet,omitempty"`
+	Fee            dcrutil.Amount `json:"fee,omitempty"`
+	Staking        string         `json:"staking,omitempty"`
+	RequestID      string         `json:"requestid,omitempty"`
+	Purpose        string         `json:"purpose,omitempty"`
+	Simulated      bool           `json:"simulated,omitempty"`
+}
+
+// client performs admin API requests.
+type client struct {
+	url   string
+	token string
+}
+
+// do performs an admin API request and decodes the JSON reply into res.
+func (c *client) do(method, path string, query url.Values, body, res interface{}) error {
+	u := strings.TrimSuffix(c.url, "/") + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	return json.Unmarshal(b, res)
+}
+
+// parseTime parses a date (2006-01-02) in UTC or an RFC3339 time.
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// readPayouts reads the payout history from the faucet data directory and
+// applies the filter options, returning the most recent payouts first.
+func readPayouts(opts *options) ([]payoutRecord, error) {
+	var since, until time.Time
+	var err error
+	if opts.Since != "" {
+		if since, err = parseTime(opts.Since); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Until != "" {
+		if until, err = parseTime(opts.Until); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := os.Open(filepath.Join(opts.DataDir, payoutsFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var payouts []payoutRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var p payoutRecord
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			return nil, err
+		}
+		switch {
+		case opts.IP != "" && p.IP != opts.IP:
+		case opts.Address != "" && p.Address != opts.Address:
+		case !since.IsZero() && p.Time.Before(since):
+		case !until.IsZero() && !p.Time.Before(until):
+		default:
+			payouts = append(payouts, p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Reverse to list the most recent payouts first like the admin API.
+	for i, j := 0, len(payouts)-1; i < j; i, j = i+1, j-1 {
+		payouts[i], payouts[j] = payouts[j], payouts[i]
+	}
+	if opts.Limit > 0 && len(payouts) > opts.Limit {
+		payouts = payouts[:opts.Limit]
+	}
+	return payouts, nil
+}
+
+// fetchPayouts returns the payouts matching the filter options, either from
+// the admin API or from the data directory.
+func fetchPayouts(c *client, opts *options) ([]payoutRecord, error) {
+	if opts.Offline {
+		return readPayouts(opts)
+	}
+
+	query := url.Values{}
+	for k, v := range map[string]string{
+		"ip":      opts.IP,
+		"address": opts.Address,
+		"since":   opts.Since,
+		"until":   opts.Until,
+	} {
+		if v != "" {
+			query.Set(k, v)
+		}
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	var payouts []payoutRecord
+	err := c.do(http.MethodGet, "/admin/payouts", query, nil, &payouts)
+	return payouts, err
+}
+
+// printPayouts writes the payouts as a table followed by their total.
+func printPayouts(w io.Writer, payouts []payoutRecord) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tIP\tADDRESS\tAMOUNT\tFEE\tTOKEN\tTXID\tREQUEST\tPURPOSE")
+	var total dcrutil.Amount
+	for _, p := range payouts {
+		txid := p.TxID
+		if p.Simulated {
+			txid += " (simulated)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%v\t%s\t%s\t%s\t%s\n",
+			p.Time.Format(time.RFC3339), p.IP, p.Address, p.Amount, p.Fee,
+			p.Token, txid, p.RequestID, p.Purpose)
+		total += p.Amount
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d payout(s) totaling %v\n", len(payouts), total)
+}
+
+// exportPayouts writes the payouts in the requested format.
+func exportPayouts(w io.Writer, payouts []payoutRecord, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(payouts)
+
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "ip", "address", "amount", "fee", "token",
+			"txid", "requestid", "purpose", "subject"})
+		for _, p := range payouts {
+			cw.Write([]string{
+				p.Time.Format(time.RFC3339),
+				p.IP,
+				p.Address,
+				strconv.FormatFloat(p.Amount.ToCoin(), 'f', -1, 64),
+				strconv.FormatFloat(p.Fee.ToCoin(), 'f', -1, 64),
+				p.Token,
+				p.TxID,
+				p.RequestID,
+				p.Purpose,
+				p.Subject,
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+// printJSON writes v as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func run() error {
+	opts := options{
+		AdminURL: defaultAdminURL,
+		DataDir:  defaultDataDir,
+		Format:   "csv",
+	}
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.Usage = usage
+	args, err := parser.Parse()
+	if err != nil {
+		var e *flags.Error
+		if errors.As(err, &e) && e.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		return err
+	}
+	if len(args) == 0 {
+		parser.WriteHelp(os.Stderr)
+		return errors.New("no command specified")
+	}
+
+	c := &client{url: opts.AdminURL, token: opts.AdminToken}
+	cmd, args := args[0], args[1:]
+
+	switch cmd {
+	case "payouts", "export":
+		payouts, err := fetchPayouts(c, &opts)
+		if err != nil {
+			return err
+		}
+		if cmd == "export" {
+			return exportPayouts(os.Stdout, payouts, opts.Format)
+		}
+		printPayouts(os.Stdout, payouts)
+		return nil
+	}
+
+	if opts.Offline {
+		return fmt.Errorf("command %q is not available with --offline", cmd)
+	}
+
+	var res json.RawMessage
+	switch cmd {
+	case "status":
+		err = c.do(http.MethodGet, "/admin/status", nil, nil, &res)
+	case "blocked":
+		err = c.do(http.MethodGet, "/admin/blocked", nil, nil, &res)
+	case "block", "unblock":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s <address>", cmd)
+		}
+		body := map[string]string{"address": args[0]}
+		err = c.do(http.MethodPost, "/admin/"+cmd, nil, body, &res)
+	case "clearcooldown":
+		if len(args) > 1 || (len(args) == 1 && opts.Subject != "") {
+			return errors.New("usage: clearcooldown [ip] or " +
+				"--subject <subject> clearcooldown")
+		}
+		body := map[string]string{"ip": "", "subject": opts.Subject}
+		if len(args) == 1 {
+			body["ip"] = args[0]
+		}
+		err = c.do(http.MethodPost, "/admin/clearcooldown", nil, body, &res)
+	case "pause", "resume":
+		err = c.do(http.MethodPost, "/admin/"+cmd, nil, struct{}{}, &res)
+	case "apikeys":
+		err = c.do(http.MethodGet, "/admin/apikeys", nil, nil, &res)
+	case "createkey":
+		if len(args) != 1 {
+			return errors.New("usage: createkey <name>")
+		}
+		body := map[string]interface{}{
+			"name":       args[0],
+			"dailyquota": opts.Quota,
+			"rate":       opts.Rate,
+			"maxamount":  opts.MaxAmount,
+		}
+		err = c.do(http.MethodPost, "/admin/apikeys", nil, body, &res)
+	case "revokekey":
+		if len(args) != 1 {
+			return errors.New("usage: revokekey <id>")
+		}
+		body := map[string]string{"id": args[0]}
+		err = c.do(http.MethodPost, "/admin/apikeys/revoke", nil, body, &res)
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
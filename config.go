@@ -16,7 +16,9 @@ import (
 	"strings"
 	"time"
 
+	"decred.org/dcrwallet/v3/rpc/client/dcrwallet"
 	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/decred/dcrd/txscript/v4/stdaddr"
 	flags "github.com/jessevdk/go-flags"
 )
 
@@ -27,6 +29,14 @@ const (
 	defaultLogLevel              = "info"
 	defaultLogDirname            = "logs"
 	defaultLogFilename           = "testnetfaucet.log"
+	defaultAuditLogFilename      = "audit.log"
+	defaultLimitPolicy           = limitPolicyPercent
+	defaultLimitPercent          = 1
+	defaultUTXOPoolAmount        = 5
+	defaultReturnAddrGapPolicy   = "error"
+	defaultPayoutQueueSize       = 100
+	defaultStakingCooldown       = 24 * time.Hour
+	defaultStakingDailyLimit     = 5
 	defaultListen                = ":8000"
 	defaultPublicPath            = "public"
 	defaultTemplatePath          = "views"
@@ -52,32 +62,76 @@ var runServiceCommand func(string) error
 //
 // See loadConfig for details on the configuration load process.
 type config struct {
-	ShowVersion         bool    `short:"V" long:"version" description:"Display version information and exit"`
-	ConfigFile          string  `short:"C" long:"configfile" description:"Path to configuration file"`
-	DataDir             string  `short:"b" long:"datadir" description:"Directory to store data"`
-	LogDir              string  `long:"logdir" description:"Directory to log output."`
-	Listen              string  `long:"listen" description:"Listen for connections on the specified interface/port (default all interfaces port: 9113, testnet: 19113)"`
-	TestNet             bool    `long:"testnet" description:"Use the test network"`
-	SimNet              bool    `long:"simnet" description:"Use the simulation test network"`
-	Profile             string  `long:"profile" description:"Enable HTTP profiling on given port -- NOTE port must be between 1024 and 65536"`
-	CPUProfile          string  `long:"cpuprofile" description:"Write CPU profile to the specified file"`
-	MemProfile          string  `long:"memprofile" description:"Write mem profile to the specified file"`
-	DebugLevel          string  `short:"d" long:"debuglevel" description:"Logging level for all subsystems {trace, debug, info, warn, error, critical} -- You may also specify <subsystem>=<level>,<subsystem2>=<level>,... to set the log level for individual subsystems -- Use show to list available subsystems"`
-	OverrideToken       string  `long:"overridetoken" description:"Secret override token to skip time check."`
-	PublicPath          string  `long:"publicpath" description:"Path to the public folder which contains css/fonts/images/javascript."`
-	TemplatePath        string  `long:"templatepath" description:"Path to the views folder which contains html files."`
-	WalletAccount       string  `long:"walletaccount" description:"Account to send funds from."`
-	WalletAddress       string  `long:"walletaddress" description:"Wallet address for returning coins."`
-	WalletHost          string  `long:"wallethost" description:"Hostname for wallet server."`
-	WalletUser          string  `long:"walletuser" description:"Username for wallet server."`
-	WalletPassword      string  `long:"walletpassword" description:"Password for wallet server."`
-	WalletCert          string  `long:"walletcert" description:"Certificate path for wallet server."`
-	WithdrawalTimeLimit int64   `long:"withdrawaltimelimit" description:"Number of seconds before a second withdrawal can be made."`
-	WithdrawalAmount    float64 `long:"withdrawalamount" description:"Amount of testnet DCR to send with each request."`
+	ShowVersion         bool          `short:"V" long:"version" description:"Display version information and exit"`
+	ConfigFile          string        `short:"C" long:"configfile" description:"Path to configuration file"`
+	DataDir             string        `short:"b" long:"datadir" description:"Directory to store data"`
+	LogDir              string        `long:"logdir" description:"Directory to log output."`
+	Listen              string        `long:"listen" description:"Listen for connections on the specified interface/port (default all interfaces port: 9113, testnet: 19113)"`
+	TestNet             bool          `long:"testnet" description:"Use the test network"`
+	SimNet              bool          `long:"simnet" description:"Use the simulation test network"`
+	Profile             string        `long:"profile" description:"Enable HTTP profiling on given port -- NOTE port must be between 1024 and 65536"`
+	CPUProfile          string        `long:"cpuprofile" description:"Write CPU profile to the specified file"`
+	MemProfile          string        `long:"memprofile" description:"Write mem profile to the specified file"`
+	DebugLevel          string        `short:"d" long:"debuglevel" description:"Logging level for all subsystems {trace, debug, info, warn, error, critical} -- You may also specify <subsystem>=<level>,<subsystem2>=<level>,... to set the log level for individual subsystems -- Use show to list available subsystems"`
+	OverrideToken       string        `long:"overridetoken" description:"Secret override token to skip time check."`
+	PublicPath          string        `long:"publicpath" description:"Path to the public folder which contains css/fonts/images/javascript."`
+	TemplatePath        string        `long:"templatepath" description:"Path to the views folder which contains html files."`
+	WalletAccount       string        `long:"walletaccount" description:"Account to send funds from."`
+	WalletAddress       string        `long:"walletaddress" description:"Wallet address for returning coins."`
+	WalletHost          string        `long:"wallethost" description:"Hostname for wallet server."`
+	WalletUser          string        `long:"walletuser" description:"Username for wallet server."`
+	WalletPassword      string        `long:"walletpassword" description:"Password for wallet server."`
+	WalletCert          string        `long:"walletcert" description:"Certificate path for wallet server."`
+	ReserveAccount      string        `long:"reserveaccount" description:"Account of the primary wallet walletaccount is refilled from when its balance drops below refilllow (refills are disabled by default)."`
+	RefillLow           float64       `long:"refilllow" description:"Balance in DCR of walletaccount below which it is refilled from reserveaccount."`
+	RefillHigh          float64       `long:"refillhigh" description:"Balance in DCR of walletaccount a refill tops up to."`
+	RefillDailyCap      float64       `long:"refilldailycap" description:"Maximum amount in DCR moved from reserveaccount within 24 hours (0 is unlimited)."`
+	Wallets             []string      `long:"wallet" description:"Additional wallet server payouts are sent from when the wallets before it are unavailable, as host,user,password,cert[,account].  The account defaults to walletaccount.  May be specified multiple times in order of priority."`
+	WithdrawalTimeLimit int64         `long:"withdrawaltimelimit" description:"Number of seconds before a second withdrawal can be made."`
+	WithdrawalAmount    float64       `long:"withdrawalamount" description:"Amount of testnet DCR to send with each request."`
+	LimitPolicy         string        `long:"limitpolicy" description:"Policy used to compute the maximum amount sent per request {fixed, percent, tiered}."`
+	LimitAmount         float64       `long:"limitamount" description:"Maximum amount of DCR sent per request when limitpolicy=fixed."`
+	LimitPercent        float64       `long:"limitpercent" description:"Percentage of the spendable balance sent at most per request when limitpolicy=percent."`
+	LimitFloor          float64       `long:"limitfloor" description:"Minimum per request limit in DCR when limitpolicy=percent."`
+	LimitCeiling        float64       `long:"limitceiling" description:"Maximum per request limit in DCR when limitpolicy=percent (0 disables the ceiling)."`
+	LimitTiers          []string      `long:"limittier" description:"Per request limit for a balance range as minbalance:amount in DCR when limitpolicy=tiered.  May be specified multiple times."`
+	PayoutTiers         []string      `long:"payouttier" description:"Payout tier selectable by requesters as name:amount:cooldown[:dailybudget] with amounts in DCR and the cooldown as a duration such as 30s or 1h.  May be specified multiple times.  Defaults to a single tier using withdrawalamount and withdrawaltimelimit."`
+	UTXOPoolSize        int           `long:"utxopoolsize" description:"Number of confirmed outputs to keep available for payouts (0 disables UTXO pool management)."`
+	UTXOPoolAmount      float64       `long:"utxopoolamount" description:"Amount of DCR in each output of the UTXO pool."`
+	RotateReturnAddress bool          `long:"rotatereturnaddress" description:"Show a fresh return address from walletaccount to every session instead of walletaddress."`
+	ReturnAddrGapPolicy string        `long:"returnaddressgappolicy" description:"Gap limit policy used when creating rotated return addresses {error, ignore, wrap}."`
+	PayoutQueueSize     int           `long:"payoutqueuesize" description:"Maximum number of payout requests waiting to be sent."`
+	FeeRate             float64       `long:"feerate" description:"Fee rate in DCR/kB of payout transactions (default: the fee rate of the wallet)."`
+	AddressTypes        []string      `long:"addresstype" description:"Address type payouts may be sent to {p2pkh-ecdsa, p2pkh-ed25519, p2pkh-schnorr, p2pk, p2sh}.  Stake outputs such as ticket commitments pay p2pkh-ecdsa and p2sh addresses, so there are no separate stake address types.  May be specified multiple times (default: all types)."`
+	DryRun              bool          `long:"dryrun" description:"Run the full request path but only sign payouts without broadcasting them.  Simulated payouts are kept in the dryrun directory of datadir."`
+	MemoOutput          bool          `long:"memooutput" description:"Commit the request ID and purpose of every payout in a null-data output of its transaction."`
+	Staking             bool          `long:"staking" description:"Let users request a ticket purchase voting with their address, or the current ticket price, from walletaccount of the primary wallet."`
+	StakingCooldown     time.Duration `long:"stakingcooldown" description:"Time a client must wait between staking requests."`
+	StakingDailyLimit   int           `long:"stakingdailylimit" description:"Maximum number of staking requests served within 24 hours."`
+	StakingMaxPrice     float64       `long:"stakingmaxprice" description:"Ticket price in DCR above which staking requests are refused.  Required with staking."`
+	OIDCIssuer          string        `long:"oidcissuer" description:"OpenID Connect issuer URL, or github, of the identity provider users log in with (login is disabled by default)."`
+	OIDCClientID        string        `long:"oidcclientid" description:"Client ID registered with the identity provider."`
+	OIDCClientSecret    string        `long:"oidcclientsecret" description:"Client secret registered with the identity provider."`
+	OIDCRedirectURL     string        `long:"oidcredirecturl" description:"Public URL of the /auth/callback endpoint registered with the identity provider."`
+	OIDCScopes          string        `long:"oidcscopes" description:"Space separated scopes requested from the identity provider (default: openid profile, or read:user for github)."`
+	OIDCTiers           []string      `long:"oidctier" description:"Payout tier only available to logged in users.  The cooldown of logged in users applies per user rather than per IP.  May be specified multiple times."`
+	AdminListen         string        `long:"adminlisten" description:"Listen for admin API connections on the specified interface/port (disabled by default)."`
+	AdminToken          string        `long:"admintoken" description:"Secret bearer token required by the admin API."`
 	Version             string
 
 	withdrawalAmount    dcrutil.Amount
 	withdrawalTimeLimit time.Duration
+	limitPolicy         limitPolicy
+	payoutTiers         []*payoutTier
+	utxoPoolAmount      dcrutil.Amount
+	walletEndpoints     []walletEndpoint
+	refillLow           dcrutil.Amount
+	refillHigh          dcrutil.Amount
+	refillDailyCap      dcrutil.Amount
+	feeRate             dcrutil.Amount
+	stakingMaxPrice     dcrutil.Amount
+	stakingTier         *payoutTier
+	addressTypes        map[string]bool
 }
 
 // serviceOptions defines the configuration options for the daemon as a service
@@ -238,6 +292,14 @@ func loadConfig() (*config, []string, error) {
 		WalletCert:          defaultWallertCert,
 		WithdrawalAmount:    defaultWithdrawalAmount,
 		WithdrawalTimeLimit: defaultWithdrawalTimeSeconds,
+		LimitPolicy:         defaultLimitPolicy,
+		LimitPercent:        defaultLimitPercent,
+		UTXOPoolAmount:      defaultUTXOPoolAmount,
+		ReturnAddrGapPolicy: defaultReturnAddrGapPolicy,
+		PayoutQueueSize:     defaultPayoutQueueSize,
+		StakingCooldown:     defaultStakingCooldown,
+		StakingDailyLimit:   defaultStakingDailyLimit,
+		OIDCRedirectURL:     defaultBaseURL + "/auth/callback",
 		Version:             version(),
 	}
 
@@ -354,6 +416,7 @@ func loadConfig() (*config, []string, error) {
 	// Initialize log rotation.  After log rotation has been initialized, the
 	// logger variables may be used.
 	initLogRotator(filepath.Join(cfg.LogDir, defaultLogFilename))
+	initAuditLog(filepath.Join(cfg.LogDir, defaultAuditLogFilename))
 
 	// Parse, validate, and set debug log level(s).
 	if err := parseAndSetDebugLevels(cfg.DebugLevel); err != nil {
@@ -382,6 +445,13 @@ func loadConfig() (*config, []string, error) {
 		return nil, nil, err
 	}
 
+	if cfg.AdminListen != "" && cfg.AdminToken == "" {
+		str := "%s: admintoken is required when adminlisten is set"
+		err := fmt.Errorf(str, funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
 	if cfg.WalletHost == "" {
 		str := "%s: wallethost is not set in config"
 		err := fmt.Errorf(str, funcName)
@@ -426,6 +496,174 @@ func loadConfig() (*config, []string, error) {
 	}
 	cfg.withdrawalTimeLimit = time.Duration(cfg.WithdrawalTimeLimit) * time.Second
 
+	cfg.payoutTiers, err = newPayoutTiers(&cfg)
+	if err != nil {
+		err := fmt.Errorf("%s: %v", funcName, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	cfg.feeRate, err = dcrutil.NewAmount(cfg.FeeRate)
+	if err != nil || cfg.feeRate < 0 {
+		str := "%s: invalid feerate: %v"
+		err := fmt.Errorf(str, funcName, cfg.FeeRate)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	for _, t := range cfg.payoutTiers {
+		if t.Name == bulkTierName {
+			str := "%s: payout tier name %q is reserved for bulk " +
+				"requests"
+			err := fmt.Errorf(str, funcName, bulkTierName)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+	}
+
+	cfg.addressTypes, err = parseAddressTypes(cfg.AddressTypes)
+	if err != nil {
+		err := fmt.Errorf("%s: invalid addresstype: %v", funcName, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if cfg.Staking {
+		cfg.stakingMaxPrice, err = dcrutil.NewAmount(cfg.StakingMaxPrice)
+		if err != nil || cfg.stakingMaxPrice <= 0 {
+			str := "%s: stakingmaxprice must be set to a positive " +
+				"amount with staking: %v"
+			err := fmt.Errorf(str, funcName, cfg.StakingMaxPrice)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+		if cfg.StakingCooldown <= 0 || cfg.StakingDailyLimit <= 0 {
+			str := "%s: stakingcooldown and stakingdailylimit must be " +
+				"positive"
+			err := fmt.Errorf(str, funcName)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+		for _, t := range cfg.payoutTiers {
+			if t.Name == stakingTierName {
+				str := "%s: payout tier name %q is reserved for " +
+					"staking"
+				err := fmt.Errorf(str, funcName, stakingTierName)
+				fmt.Fprintln(os.Stderr, err)
+				return nil, nil, err
+			}
+		}
+		cfg.stakingTier = newStakingTier(&cfg)
+	}
+
+	if len(cfg.OIDCTiers) > 0 && cfg.OIDCIssuer == "" {
+		str := "%s: oidctier requires oidcissuer"
+		err := fmt.Errorf(str, funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.OIDCIssuer != "" && cfg.OIDCClientID == "" {
+		str := "%s: oidcissuer requires oidcclientid"
+		err := fmt.Errorf(str, funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	for _, name := range cfg.OIDCTiers {
+		var found bool
+		for _, t := range cfg.payoutTiers {
+			if t.Name == name {
+				t.LoginRequired = true
+				found = true
+			}
+		}
+		if !found {
+			str := "%s: oidctier %q is not a payout tier"
+			err := fmt.Errorf(str, funcName, name)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+	}
+
+	cfg.limitPolicy, err = newLimitPolicy(&cfg)
+	if err != nil {
+		err := fmt.Errorf("%s: %v", funcName, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if cfg.UTXOPoolSize < 0 {
+		str := "%s: utxopoolsize cannot be negative"
+		err := fmt.Errorf(str, funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+	if cfg.PayoutQueueSize <= 0 {
+		str := "%s: payoutqueuesize must be greater than 0"
+		err := fmt.Errorf(str, funcName)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	largestTier := cfg.payoutTiers[len(cfg.payoutTiers)-1]
+	cfg.utxoPoolAmount, err = dcrutil.NewAmount(cfg.UTXOPoolAmount)
+	if cfg.UTXOPoolSize > 0 && (err != nil ||
+		cfg.utxoPoolAmount <= largestTier.Amount) {
+		str := "%s: utxopoolamount must be greater than the largest " +
+			"payout amount: %v"
+		err := fmt.Errorf(str, funcName, cfg.UTXOPoolAmount)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	if cfg.ReserveAccount != "" {
+		if cfg.ReserveAccount == cfg.WalletAccount {
+			str := "%s: reserveaccount must differ from walletaccount"
+			err := fmt.Errorf(str, funcName)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+		cfg.refillLow, err = dcrutil.NewAmount(cfg.RefillLow)
+		if err != nil || cfg.refillLow <= 0 {
+			str := "%s: invalid refilllow: %v"
+			err := fmt.Errorf(str, funcName, cfg.RefillLow)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+		cfg.refillHigh, err = dcrutil.NewAmount(cfg.RefillHigh)
+		if err != nil || cfg.refillHigh <= cfg.refillLow {
+			str := "%s: refillhigh must be greater than refilllow: %v"
+			err := fmt.Errorf(str, funcName, cfg.RefillHigh)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+		cfg.refillDailyCap, err = dcrutil.NewAmount(cfg.RefillDailyCap)
+		if err != nil || cfg.refillDailyCap < 0 {
+			str := "%s: invalid refilldailycap: %v"
+			err := fmt.Errorf(str, funcName, cfg.RefillDailyCap)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+	}
+
+	_, err = stdaddr.DecodeAddress(cfg.WalletAddress, activeNetParams.Params)
+	if err != nil {
+		str := "%s: walletaddress %v is not a valid %s address: %v"
+		err := fmt.Errorf(str, funcName, cfg.WalletAddress,
+			activeNetParams.Name, err)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
+	switch dcrwallet.GapPolicy(cfg.ReturnAddrGapPolicy) {
+	case dcrwallet.GapPolicyError, dcrwallet.GapPolicyIgnore,
+		dcrwallet.GapPolicyWrap:
+	default:
+		str := "%s: unknown returnaddressgappolicy %q"
+		err := fmt.Errorf(str, funcName, cfg.ReturnAddrGapPolicy)
+		fmt.Fprintln(os.Stderr, err)
+		return nil, nil, err
+	}
+
 	// Add default wallet port for the active network if there's no port specified
 	cfg.WalletHost = normalizeAddress(cfg.WalletHost, activeNetParams.WalletRPCServerPort)
 
@@ -440,6 +678,26 @@ func loadConfig() (*config, []string, error) {
 		}
 	}
 
+	// The wallet configured by wallethost has the highest priority,
+	// followed by the additional wallets in the order given.
+	cfg.walletEndpoints = []walletEndpoint{{
+		Host:     cfg.WalletHost,
+		User:     cfg.WalletUser,
+		Password: cfg.WalletPassword,
+		Cert:     cfg.WalletCert,
+		Account:  cfg.WalletAccount,
+	}}
+	for _, s := range cfg.Wallets {
+		e, err := parseWalletEndpoint(s, cfg.WalletAccount)
+		if err != nil {
+			str := "%s: %v"
+			err := fmt.Errorf(str, funcName, err)
+			fmt.Fprintln(os.Stderr, err)
+			return nil, nil, err
+		}
+		cfg.walletEndpoints = append(cfg.walletEndpoints, e)
+	}
+
 	// Warn about missing config file only after all other configuration is
 	// done.  This prevents the warning on help messages and invalid
 	// options.  Note this should go directly before the return.
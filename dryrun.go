@@ -0,0 +1,40 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+// dryRunDirname is the directory below the data directory holding the state of
+// dry-run mode, so that simulated payouts never count towards the cooldowns
+// and budgets of real payouts.
+const dryRunDirname = "dryrun"
+
+// simulate builds and signs a transaction making the payments from wallet w
+// exactly like a payout, but does not broadcast it.  It returns the hash and
+// fee of the transaction.
+func (w *walletBackend) simulate(ctx context.Context, payments []payment,
+	minConf int, memo []byte) (*chainhash.Hash, dcrutil.Amount, error) {
+
+	tx, err := w.buildTransaction(ctx, payments, minConf, memo)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var fee int64
+	for _, in := range tx.TxIn {
+		fee += in.ValueIn
+	}
+	for _, out := range tx.TxOut {
+		fee -= out.Value
+	}
+
+	hash := tx.TxHash()
+	return &hash, dcrutil.Amount(fee), nil
+}
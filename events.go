@@ -0,0 +1,221 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+// Live event types.
+const (
+	eventPayout  = "payout"
+	eventBalance = "balance"
+	eventPaused  = "paused"
+)
+
+const (
+	// eventBufferSize is the number of events buffered per subscriber.
+	// Events are dropped for subscribers which fall further behind.
+	eventBufferSize = 16
+
+	// eventKeepaliveInterval is the interval of comments sent to keep idle
+	// event streams open through proxies.
+	eventKeepaliveInterval = 30 * time.Second
+)
+
+// payoutEvent is the data of a payout event.  Amounts are in DCR.
+type payoutEvent struct {
+	TxID    string    `json:"txid"`
+	Amount  float64   `json:"amount"`
+	Address string    `json:"address"`
+	Tier    string    `json:"tier"`
+	Time    time.Time `json:"time"`
+}
+
+// balanceEvent is the data of a balance event.  Amounts are in DCR.
+type balanceEvent struct {
+	Balance          balanceStatus `json:"balance"`
+	TransactionLimit float64       `json:"transactionlimit"`
+	SentToday        float64       `json:"senttoday"`
+}
+
+// pausedEvent is the data of a paused event.
+type pausedEvent struct {
+	Paused bool `json:"paused"`
+}
+
+// eventBroker fans out live faucet events to all subscribed event streams.
+type eventBroker struct {
+	mtx    sync.Mutex
+	subs   map[chan []byte]struct{}
+	closed bool
+}
+
+// events is the broker of live faucet events served at "/events".
+var events = &eventBroker{subs: make(map[chan []byte]struct{})}
+
+// subscribe registers a new event stream.  The returned channel is closed
+// when the broker is closed.
+func (b *eventBroker) subscribe() chan []byte {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	ch := make(chan []byte, eventBufferSize)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subs[ch] = struct{}{}
+	metricEventSubscribers.Add(1)
+	return ch
+}
+
+// unsubscribe removes an event stream.
+func (b *eventBroker) unsubscribe(ch chan []byte) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		metricEventSubscribers.Add(-1)
+	}
+}
+
+// publish sends an event of the provided type to all subscribers.
+func (b *eventBroker) publish(typ string, data interface{}) {
+	msg, err := formatEvent(typ, data)
+	if err != nil {
+		log.Errorf("failed to marshal %s event: %v", typ, err)
+		return
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- msg:
+		default:
+			metricEventsDropped.Add(1)
+		}
+	}
+}
+
+// close ends all event streams so that the HTTP server can shut down.
+func (b *eventBroker) close() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.closed = true
+	for ch := range b.subs {
+		close(ch)
+		delete(b.subs, ch)
+		metricEventSubscribers.Add(-1)
+	}
+}
+
+// formatEvent encodes an event in the server-sent events format.
+func formatEvent(typ string, data interface{}) ([]byte, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", typ, b)), nil
+}
+
+// truncateAddress shortens an address for public display.
+func truncateAddress(addr string) string {
+	if len(addr) <= 16 {
+		return addr
+	}
+	return addr[:10] + "..." + addr[len(addr)-4:]
+}
+
+// publishPayout publishes a payout event.
+func publishPayout(txid string, amount dcrutil.Amount, address, tier string) {
+	events.publish(eventPayout, &payoutEvent{
+		TxID:    txid,
+		Amount:  amount.ToCoin(),
+		Address: truncateAddress(address),
+		Tier:    tier,
+		Time:    time.Now(),
+	})
+}
+
+// currentBalanceEvent returns a balance event describing the last known
+// balance.
+func currentBalanceEvent() *balanceEvent {
+	amountMtx.RLock()
+	balance := lastBalance
+	tLimit := transactionLimit
+	amountMtx.RUnlock()
+
+	return &balanceEvent{
+		Balance:          balance.status(),
+		TransactionLimit: tLimit.ToCoin(),
+		SentToday:        calculateAmountSentToday().ToCoin(),
+	}
+}
+
+// eventsHandler is the handler for HTTP GET requests to "/events".  It streams
+// payout, balance and paused events as server-sent events, starting with the
+// current balance and paused state.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, ev := range []struct {
+		typ  string
+		data interface{}
+	}{
+		{eventBalance, currentBalanceEvent()},
+		{eventPaused, &pausedEvent{Paused: state.isPaused()}},
+	} {
+		msg, err := formatEvent(ev.typ, ev.data)
+		if err != nil {
+			log.Errorf("failed to marshal %s event: %v", ev.typ, err)
+			return
+		}
+		w.Write(msg)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(msg); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+// applyFeeRate sets the fee rate of the wallet to feerate, if configured.
+// The rate is applied before every payout since other users of the wallet may
+// change it.  The wallet is left untouched in dry-run mode, where transactions
+// are funded with the fee rate directly.
+func (w *walletBackend) applyFeeRate(ctx context.Context) error {
+	if cfg.feeRate == 0 || cfg.DryRun {
+		return nil
+	}
+	return w.client.SetTxFee(ctx, cfg.feeRate)
+}
+
+// transactionFee returns the fee paid by the transaction with the provided
+// hash as reported by wallet w.  Failures are logged and reported as a zero
+// fee, since the payout was already sent.
+func (w *walletBackend) transactionFee(ctx context.Context, hash *chainhash.Hash) dcrutil.Amount {
+	tx, err := w.client.GetTransaction(ctx, hash)
+	if err != nil {
+		log.Warnf("Unable to get the fee of %v: %v", hash, err)
+		return 0
+	}
+	// The wallet reports the fee of sent transactions as a negative
+	// amount.
+	fee, err := dcrutil.NewAmount(tx.Fee)
+	if err != nil {
+		log.Warnf("Invalid fee of %v: %v", hash, err)
+		return 0
+	}
+	if fee < 0 {
+		fee = -fee
+	}
+	return fee
+}
+
+// recordFee adds the fee of a payout to the metrics.
+func recordFee(fee dcrutil.Amount) {
+	metricPayoutFees.Add(int64(fee))
+}
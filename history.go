@@ -0,0 +1,174 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+// historyRetention is how long hourly aggregates are kept.
+const historyRetention = 31 * 24 * time.Hour
+
+// historyRange is a period of time which can be charted and the interval of
+// its buckets.
+type historyRange struct {
+	span     time.Duration
+	interval time.Duration
+}
+
+// historyRanges are the ranges served by the history API, keyed by name.
+var historyRanges = map[string]historyRange{
+	"24h": {span: 24 * time.Hour, interval: time.Hour},
+	"7d":  {span: 7 * 24 * time.Hour, interval: time.Hour},
+	"30d": {span: 30 * 24 * time.Hour, interval: 24 * time.Hour},
+}
+
+// hourlyAggregate holds the payouts and the last known balance within an
+// hour.
+type hourlyAggregate struct {
+	payouts    int
+	amount     dcrutil.Amount
+	balance    dcrutil.Amount
+	hasBalance bool
+}
+
+// historyBucket is a single bucket of the history API.  Amounts are in DCR.
+// Balance is nil when no balance is known for the bucket.
+type historyBucket struct {
+	Time    time.Time `json:"time"`
+	Payouts int       `json:"payouts"`
+	Amount  float64   `json:"amount"`
+	Balance *float64  `json:"balance"`
+}
+
+// historyResponse is the JSON reply of the history API.
+type historyResponse struct {
+	Range    string          `json:"range"`
+	Interval int64           `json:"interval"`
+	Buckets  []historyBucket `json:"buckets"`
+}
+
+// payoutHistory keeps hourly aggregates of the payouts and balance of the
+// faucet.  Payouts are loaded from the payout history on startup, while the
+// balance is sampled whenever it is updated and is not persisted.
+type payoutHistory struct {
+	mtx    sync.Mutex
+	hourly map[int64]*hourlyAggregate
+}
+
+// history holds the aggregates served at "/history".  It is loaded in main.
+var history = &payoutHistory{hourly: make(map[int64]*hourlyAggregate)}
+
+// aggregate returns the hourly aggregate containing t, creating it as needed.
+// It must be called with the mutex held.
+func (h *payoutHistory) aggregate(t time.Time) *hourlyAggregate {
+	hour := t.Truncate(time.Hour).Unix()
+	a, ok := h.hourly[hour]
+	if !ok {
+		a = new(hourlyAggregate)
+		h.hourly[hour] = a
+	}
+	return a
+}
+
+// prune removes aggregates older than historyRetention.  It must be called
+// with the mutex held.
+func (h *payoutHistory) prune() {
+	oldest := time.Now().Add(-historyRetention).Unix()
+	for hour := range h.hourly {
+		if hour < oldest {
+			delete(h.hourly, hour)
+		}
+	}
+}
+
+// load adds the payouts still within historyRetention from the payout
+// history.
+func (h *payoutHistory) load(s *stateStore) {
+	payouts := s.queryPayouts(&payoutFilter{
+		Since: time.Now().Add(-historyRetention),
+	})
+	for i := range payouts {
+		h.addPayout(payouts[i].Time, payouts[i].Amount)
+	}
+}
+
+// addPayout records a payout of amount at t.
+func (h *payoutHistory) addPayout(t time.Time, amount dcrutil.Amount) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	a := h.aggregate(t)
+	a.payouts++
+	a.amount += amount
+	h.prune()
+}
+
+// recordBalance records the current balance.
+func (h *payoutHistory) recordBalance(balance dcrutil.Amount) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	a := h.aggregate(time.Now())
+	a.balance = balance
+	a.hasBalance = true
+	h.prune()
+}
+
+// buckets returns the aggregates of rng in buckets of its interval, oldest
+// first.  The balance of a bucket is the last balance sampled within it.
+func (h *payoutHistory) buckets(rng historyRange) []historyBucket {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	now := time.Now().UTC()
+	end := now.Truncate(rng.interval).Add(rng.interval)
+	n := int(rng.span / rng.interval)
+	buckets := make([]historyBucket, 0, n)
+	for start := end.Add(-rng.span); start.Before(end); start = start.Add(rng.interval) {
+		b := historyBucket{Time: start}
+		var amount dcrutil.Amount
+		for t := start; t.Before(start.Add(rng.interval)); t = t.Add(time.Hour) {
+			a, ok := h.hourly[t.Unix()]
+			if !ok {
+				continue
+			}
+			b.Payouts += a.payouts
+			amount += a.amount
+			if a.hasBalance {
+				balance := a.balance.ToCoin()
+				b.Balance = &balance
+			}
+		}
+		b.Amount = amount.ToCoin()
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// historyHandler is the handler for HTTP GET requests to "/history".  The
+// range query parameter selects one of 24h, 7d or 30d and defaults to 24h.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("range")
+	if name == "" {
+		name = "24h"
+	}
+	rng, ok := historyRanges[name]
+	if !ok {
+		writeJSONError(w, r, http.StatusBadRequest,
+			newFaucetError(errCodeUnknownRange, name))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &historyResponse{
+		Range:    name,
+		Interval: int64(rng.interval.Seconds()),
+		Buckets:  history.buckets(rng),
+	})
+}
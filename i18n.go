@@ -0,0 +1,216 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultLanguage is the language used when a request does not ask for a
+// supported one.  Its catalog must contain every message.
+const defaultLanguage = "en"
+
+// Stable error codes of errors reported to requesters.  Each code is also the
+// key of the error message in the catalogs.
+const (
+	errCodeBadRequest            = "bad_request"
+	errCodePaused                = "paused"
+	errCodeAddressBlocked        = "address_blocked"
+	errCodeInvalidAddress        = "invalid_address"
+	errCodeAddressTypeNotAllowed = "address_type_not_allowed"
+	errCodeAddressNotStakeable   = "address_not_stakeable"
+	errCodeOwnAddress            = "own_address"
+	errCodeRateLimited           = "rate_limited"
+	errCodeAmountNotPositive     = "amount_not_positive"
+	errCodeAmountEmpty           = "amount_empty"
+	errCodeAmountInvalid         = "amount_invalid"
+	errCodeAmountAtomsInvalid    = "amount_atoms_invalid"
+	errCodeAmountTooPrecise      = "amount_too_precise"
+	errCodeAmountTooLarge        = "amount_too_large"
+	errCodeAmountConflict        = "amount_conflict"
+	errCodeAmountExceedsTier     = "amount_exceeds_tier"
+	errCodeAmountExceedsTiers    = "amount_exceeds_tiers"
+	errCodeAmountExceedsLimit    = "amount_exceeds_limit"
+	errCodeUnknownTier           = "unknown_tier"
+	errCodeLoginRequired         = "login_required"
+	errCodeTierBudgetExhausted   = "tier_budget_exhausted"
+	errCodeStakingDisabled       = "staking_disabled"
+	errCodeUnknownStakingMode    = "unknown_staking_mode"
+	errCodeStakingLimit          = "staking_limit"
+	errCodeTicketPriceTooHigh    = "ticket_price_too_high"
+	errCodeAwaitingConfirmation  = "awaiting_confirmation"
+	errCodeFundsLocked           = "funds_locked"
+	errCodeInsufficientFunds     = "insufficient_funds"
+	errCodePayoutFailed          = "payout_failed"
+	errCodeWalletUnavailable     = "wallet_unavailable"
+	errCodeInvalidAPIKey         = "invalid_api_key"
+	errCodeAPIKeyAmount          = "api_key_amount"
+	errCodeAPIKeyRate            = "api_key_rate"
+	errCodeAPIKeyQuota           = "api_key_quota"
+	errCodeAPIKeyRequired        = "api_key_required"
+	errCodeBulkEmpty             = "bulk_empty"
+	errCodeBulkTooMany           = "bulk_too_many"
+	errCodeBulkNoRecipients      = "bulk_no_recipients"
+	errCodeBulkRequiresQuota     = "bulk_requires_quota"
+	errCodeBulkNotPaid           = "bulk_not_paid"
+	errCodeDuplicateRecipient    = "duplicate_recipient"
+	errCodePurposeTooLong        = "purpose_too_long"
+	errCodePurposeTooLongBytes   = "purpose_too_long_bytes"
+	errCodePurposeInvalid        = "purpose_invalid"
+	errCodeIdempotencyKeyLength  = "idempotency_key_too_long"
+	errCodeIdempotencyKeyReused  = "idempotency_key_reused"
+	errCodeQueueFull             = "queue_full"
+	errCodeRequestPending        = "request_pending"
+	errCodeShuttingDown          = "shutting_down"
+	errCodeUnknownRequest        = "unknown_request"
+	errCodeUnknownRange          = "unknown_range"
+)
+
+// catalog maps message keys to fmt format strings.
+type catalog map[string]string
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// catalogs holds the message catalog of every supported language.
+var catalogs = loadCatalogs()
+
+// loadCatalogs parses the embedded message catalogs.  Messages missing from a
+// translation fall back to the default language.
+func loadCatalogs() map[string]catalog {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := make(map[string]catalog, len(files))
+	for _, f := range files {
+		b, err := localeFiles.ReadFile(path.Join("locales", f.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var c catalog
+		if err := json.Unmarshal(b, &c); err != nil {
+			panic(fmt.Sprintf("locales/%s: %v", f.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(f.Name(), ".json")] = c
+	}
+	if _, ok := catalogs[defaultLanguage]; !ok {
+		panic("missing catalog of the default language")
+	}
+	return catalogs
+}
+
+// translate formats the message with the provided key in lang.
+func translate(lang, key string, args ...interface{}) string {
+	format, ok := catalogs[lang][key]
+	if !ok {
+		format, ok = catalogs[defaultLanguage][key]
+		if !ok {
+			return key
+		}
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// languages returns the supported languages in sorted order.
+func languages() []string {
+	langs := make([]string, 0, len(catalogs))
+	for lang := range catalogs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// supportedLanguage returns the supported language matching the language tag,
+// or an empty string.  Only the primary language subtag is considered.
+func supportedLanguage(tag string) string {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(tag, "-_"); i >= 0 {
+		tag = tag[:i]
+	}
+	if _, ok := catalogs[tag]; ok {
+		return tag
+	}
+	return ""
+}
+
+// requestLanguage returns the language of the reply to r, chosen by the lang
+// parameter or otherwise the Accept-Language header.
+func requestLanguage(r *http.Request) string {
+	if lang := supportedLanguage(r.FormValue("lang")); lang != "" {
+		return lang
+	}
+
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v := strings.TrimSpace(params); strings.HasPrefix(v, "q=") {
+			var err error
+			if q, err = strconv.ParseFloat(v[2:], 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].q > tags[j].q
+	})
+	for _, t := range tags {
+		if lang := supportedLanguage(t.tag); lang != "" {
+			return lang
+		}
+	}
+	return defaultLanguage
+}
+
+// faucetError is an error reported to requesters.  Its message is looked up
+// by the error code in the catalog of the requester's language.
+type faucetError struct {
+	Code string
+	Args []interface{}
+}
+
+// newFaucetError returns a faucetError with the provided code and message
+// arguments.
+func newFaucetError(code string, args ...interface{}) *faucetError {
+	return &faucetError{Code: code, Args: args}
+}
+
+// Error returns the message of the error in the default language.
+func (e *faucetError) Error() string {
+	return e.localize(defaultLanguage)
+}
+
+// localize returns the message of the error in lang.
+func (e *faucetError) localize(lang string) string {
+	return translate(lang, e.Code, e.Args...)
+}
+
+// localizeError returns the stable code and the message in lang of err.  Errors
+// which are not faucetErrors are reported with the bad_request code and their
+// untranslated message.
+func localizeError(err error, lang string) (code, msg string) {
+	var fe *faucetError
+	if errors.As(err, &fe) {
+		return fe.Code, fe.localize(lang)
+	}
+	return errCodeBadRequest, err.Error()
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+// Supported transaction limit policies.
+const (
+	limitPolicyFixed   = "fixed"
+	limitPolicyPercent = "percent"
+	limitPolicyTiered  = "tiered"
+)
+
+// limitPolicy computes the maximum amount which may be sent in a single
+// request given the current spendable balance of the faucet.
+type limitPolicy interface {
+	// limit returns the transaction limit for the provided balance.  The
+	// returned limit never exceeds the balance.
+	limit(balance dcrutil.Amount) dcrutil.Amount
+
+	// String returns a human readable description of the policy.
+	String() string
+}
+
+// fixedLimit is a limitPolicy which always allows the same amount regardless of
+// the balance.
+type fixedLimit struct {
+	amount dcrutil.Amount
+}
+
+func (l *fixedLimit) limit(balance dcrutil.Amount) dcrutil.Amount {
+	return minAmount(l.amount, balance)
+}
+
+func (l *fixedLimit) String() string {
+	return fmt.Sprintf("fixed %v", l.amount)
+}
+
+// percentLimit is a limitPolicy which allows a percentage of the balance,
+// bounded by an optional floor and ceiling.  A zero ceiling disables the upper
+// bound.
+type percentLimit struct {
+	percent float64
+	floor   dcrutil.Amount
+	ceiling dcrutil.Amount
+}
+
+func (l *percentLimit) limit(balance dcrutil.Amount) dcrutil.Amount {
+	limit := dcrutil.Amount(math.Floor(float64(balance) * l.percent / 100))
+	if limit < l.floor {
+		limit = l.floor
+	}
+	if l.ceiling > 0 && limit > l.ceiling {
+		limit = l.ceiling
+	}
+	return minAmount(limit, balance)
+}
+
+func (l *percentLimit) String() string {
+	s := fmt.Sprintf("%v%% of balance", l.percent)
+	if l.floor > 0 {
+		s += fmt.Sprintf(", floor %v", l.floor)
+	}
+	if l.ceiling > 0 {
+		s += fmt.Sprintf(", ceiling %v", l.ceiling)
+	}
+	return s
+}
+
+// limitTier is a single balance range of a tieredLimit.  The tier applies when
+// the balance is at least minBalance.
+type limitTier struct {
+	minBalance dcrutil.Amount
+	amount     dcrutil.Amount
+}
+
+// tieredLimit is a limitPolicy which selects a fixed limit depending on the
+// range the balance falls in.  Tiers are sorted by ascending minBalance.
+type tieredLimit struct {
+	tiers []limitTier
+}
+
+func (l *tieredLimit) limit(balance dcrutil.Amount) dcrutil.Amount {
+	var limit dcrutil.Amount
+	for _, tier := range l.tiers {
+		if balance < tier.minBalance {
+			break
+		}
+		limit = tier.amount
+	}
+	return minAmount(limit, balance)
+}
+
+func (l *tieredLimit) String() string {
+	tiers := make([]string, 0, len(l.tiers))
+	for _, tier := range l.tiers {
+		tiers = append(tiers, fmt.Sprintf("%v when balance >= %v",
+			tier.amount, tier.minBalance))
+	}
+	return "tiered (" + strings.Join(tiers, "; ") + ")"
+}
+
+// minAmount returns the smaller of the two passed amounts.
+func minAmount(a, b dcrutil.Amount) dcrutil.Amount {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// parseLimitTier parses a tier specified as "minbalance:amount" where both
+// values are in DCR.
+func parseLimitTier(s string) (limitTier, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 2 {
+		return limitTier{}, fmt.Errorf("limit tier %q is not in the "+
+			"form minbalance:amount", s)
+	}
+
+	var amounts [2]dcrutil.Amount
+	for i, field := range fields {
+		f, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return limitTier{}, fmt.Errorf("limit tier %q: %v", s, err)
+		}
+		amounts[i], err = dcrutil.NewAmount(f)
+		if err != nil || amounts[i] < 0 {
+			return limitTier{}, fmt.Errorf("limit tier %q: invalid "+
+				"amount %q", s, field)
+		}
+	}
+
+	return limitTier{minBalance: amounts[0], amount: amounts[1]}, nil
+}
+
+// newLimitPolicy creates the limit policy described by the configuration.
+func newLimitPolicy(cfg *config) (limitPolicy, error) {
+	switch cfg.LimitPolicy {
+	case limitPolicyFixed:
+		amount, err := dcrutil.NewAmount(cfg.LimitAmount)
+		if err != nil || amount <= 0 {
+			return nil, fmt.Errorf("invalid limitamount: %v",
+				cfg.LimitAmount)
+		}
+		return &fixedLimit{amount: amount}, nil
+
+	case limitPolicyPercent:
+		if cfg.LimitPercent <= 0 || cfg.LimitPercent > 100 {
+			return nil, fmt.Errorf("limitpercent must be in the range "+
+				"(0, 100]: %v", cfg.LimitPercent)
+		}
+		floor, err := dcrutil.NewAmount(cfg.LimitFloor)
+		if err != nil || floor < 0 {
+			return nil, fmt.Errorf("invalid limitfloor: %v",
+				cfg.LimitFloor)
+		}
+		ceiling, err := dcrutil.NewAmount(cfg.LimitCeiling)
+		if err != nil || ceiling < 0 {
+			return nil, fmt.Errorf("invalid limitceiling: %v",
+				cfg.LimitCeiling)
+		}
+		if ceiling > 0 && floor > ceiling {
+			return nil, fmt.Errorf("limitfloor %v exceeds limitceiling %v",
+				floor, ceiling)
+		}
+		return &percentLimit{
+			percent: cfg.LimitPercent,
+			floor:   floor,
+			ceiling: ceiling,
+		}, nil
+
+	case limitPolicyTiered:
+		if len(cfg.LimitTiers) == 0 {
+			return nil, fmt.Errorf("limitpolicy %q requires at least "+
+				"one limittier", limitPolicyTiered)
+		}
+		tiers := make([]limitTier, 0, len(cfg.LimitTiers))
+		for _, s := range cfg.LimitTiers {
+			tier, err := parseLimitTier(s)
+			if err != nil {
+				return nil, err
+			}
+			tiers = append(tiers, tier)
+		}
+		sort.Slice(tiers, func(i, j int) bool {
+			return tiers[i].minBalance < tiers[j].minBalance
+		})
+		for i := 1; i < len(tiers); i++ {
+			if tiers[i].minBalance == tiers[i-1].minBalance {
+				return nil, fmt.Errorf("duplicate limit tier for "+
+					"balance %v", tiers[i].minBalance)
+			}
+		}
+		return &tieredLimit{tiers: tiers}, nil
+	}
+
+	return nil, fmt.Errorf("unknown limitpolicy %q -- supported policies "+
+		"are %s, %s and %s", cfg.LimitPolicy, limitPolicyFixed,
+		limitPolicyPercent, limitPolicyTiered)
+}
@@ -42,7 +42,10 @@ var (
 	// application shutdown.
 	logRotator *rotator.Rotator
 
-	log = backendLog.Logger("FAUC")
+	log       = backendLog.Logger("FAUC")
+	poolLog   = backendLog.Logger("POOL")
+	authLog   = backendLog.Logger("AUTH")
+	walletLog = backendLog.Logger("WLLT")
 )
 
 // Initialize package-global logger variables.
@@ -52,6 +55,9 @@ func init() {
 // subsystemLoggers maps each subsystem identifier to its associated logger.
 var subsystemLoggers = map[string]slog.Logger{
 	"FAUC": log,
+	"POOL": poolLog,
+	"AUTH": authLog,
+	"WLLT": walletLog,
 }
 
 // initLogRotator initializes the logging rotater to write logs to logFile and
@@ -8,21 +8,20 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"html/template"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"net"
 
 	"decred.org/dcrwallet/v3/rpc/client/dcrwallet"
-	"github.com/decred/dcrd/chaincfg/v3"
 	"github.com/decred/dcrd/dcrutil/v4"
-	"github.com/decred/dcrd/rpcclient/v8"
 	"github.com/decred/dcrd/txscript/v4/stdaddr"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -32,39 +31,160 @@ var (
 	// Configuration
 	cfg *config
 
-	// Daemon Params to use
-	dcrwClient *dcrwallet.Client
-
 	amountMtx        sync.RWMutex
-	lastBalance      dcrutil.Amount
+	lastBalance      walletBalance
 	transactionLimit dcrutil.Amount
 
-	requestMtx     sync.RWMutex
-	requestAmounts map[time.Time]dcrutil.Amount
-	requestIPs     map[string]time.Time
+	// returns tracks coins sent back to the faucet return addresses.
+	returns *returnsTracker
+
+	// returnAddrs issues rotated return addresses.  It is nil unless
+	// rotatereturnaddress is set.
+	returnAddrs *returnAddressIssuer
+
+	// requestMtx serializes payouts.  Every transaction the faucet funds
+	// from its wallets is created with it held, since the inputs a wallet
+	// selects are not locked until the transaction is published, or until
+	// sendWithMemo locks them.  The wallet accounts must not be spent from
+	// by anything but the faucet.
+	requestMtx sync.Mutex
 )
 
 type jsonResponse struct {
-	TxID  string `json:"txid"`
-	Error string `json:"error"`
+	TxID      string `json:"txid"`
+	Error     string `json:"error"`
+	Code      string `json:"code,omitempty"`
+	Simulated bool   `json:"simulated,omitempty"`
+}
+
+// balanceStatus is the balance breakdown returned by the status API in DCR.
+type balanceStatus struct {
+	Available       float64 `json:"available"`
+	Spendable       float64 `json:"spendable"`
+	Unconfirmed     float64 `json:"unconfirmed"`
+	Immature        float64 `json:"immature"`
+	LockedByTickets float64 `json:"lockedbytickets"`
+	VotingAuthority float64 `json:"votingauthority"`
+	Total           float64 `json:"total"`
+}
+
+// tierStatus describes a payout tier in the status API.  Amounts are in DCR
+// and the cooldown is in seconds.  A zero budget is unlimited.
+type tierStatus struct {
+	Name            string  `json:"name"`
+	Amount          float64 `json:"amount"`
+	Cooldown        int64   `json:"cooldown"`
+	Budget          float64 `json:"budget"`
+	BudgetRemaining float64 `json:"budgetremaining"`
+}
+
+// statusResponse is the reply of the status API.  All amounts are in DCR.
+type statusResponse struct {
+	Balance             balanceStatus `json:"balance"`
+	Tiers               []tierStatus  `json:"tiers"`
+	TransactionLimit    float64       `json:"transactionlimit"`
+	WithdrawalAmount    float64       `json:"withdrawalamount"`
+	WithdrawalTimeLimit int64         `json:"withdrawaltimelimit"`
+	SentToday           float64       `json:"senttoday"`
+	ReturnedToday       float64       `json:"returnedtoday"`
+	ReturnedTotal       float64       `json:"returnedtotal"`
+	FeesToday           float64       `json:"feestoday"`
+	FeesTotal           float64       `json:"feestotal"`
+	Paused              bool          `json:"paused"`
+	DryRun              bool          `json:"dryrun"`
+	QueueDepth          int           `json:"queuedepth"`
+}
+
+// tierInfo describes a payout tier on the page.
+type tierInfo struct {
+	Name     string
+	Amount   dcrutil.Amount
+	Cooldown time.Duration
 }
 
 // Overall Data structure given to the template to render
 type testnetFaucetInfo struct {
 	Address          string
 	Amount           dcrutil.Amount
+	EffectiveAmount  dcrutil.Amount
 	BlockHeight      int64
 	Balance          dcrutil.Amount
+	Balances         walletBalance
 	TransactionLimit dcrutil.Amount
 	Error            string
 	TimeLimit        time.Duration
 	SentToday        dcrutil.Amount
+	ReturnedToday    dcrutil.Amount
+	ReturnedTotal    dcrutil.Amount
+	TopReturners     []returnerStat
+	Tiers            []tierInfo
+	Paused           bool
 	Success          string
+	Lang             string
+	Languages        []string
+	LoginEnabled     bool
+	User             string
+	Staking          bool
+	Simulated        bool
 }
 
 // index is the handler for HTTP GET requests to "/".
 func index(w http.ResponseWriter, r *http.Request) {
-	sendReply(w, r, "", "")
+	sendReply(w, r, "", nil)
+}
+
+// status is the handler for HTTP GET requests to "/status".  It reports the
+// balance breakdown and limits of the faucet as JSON.
+func status(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(currentStatus()); err != nil {
+		log.Errorf("failed to write status reply: %v", err)
+	}
+}
+
+// currentStatus returns the balance breakdown and limits of the faucet.
+func currentStatus() *statusResponse {
+	amountMtx.RLock()
+	balance := lastBalance
+	tLimit := transactionLimit
+	amountMtx.RUnlock()
+
+	dayAgo := time.Now().Add(-time.Hour * 24)
+	tiers := make([]tierStatus, 0, len(cfg.payoutTiers))
+	for _, t := range cfg.payoutTiers {
+		ts := tierStatus{
+			Name:     t.Name,
+			Amount:   effectiveAmount(t, tLimit).ToCoin(),
+			Cooldown: int64(t.Cooldown.Seconds()),
+			Budget:   t.Budget.ToCoin(),
+		}
+		if t.Budget > 0 {
+			remaining := t.Budget - state.sentSince(dayAgo, t.Name)
+			if remaining < 0 {
+				remaining = 0
+			}
+			ts.BudgetRemaining = remaining.ToCoin()
+		}
+		tiers = append(tiers, ts)
+	}
+
+	returnedToday, returnedTotal := returns.totals()
+	resp := &statusResponse{
+		Balance:             balance.status(),
+		Tiers:               tiers,
+		TransactionLimit:    tLimit.ToCoin(),
+		WithdrawalAmount:    effectiveAmount(cfg.payoutTiers[0], tLimit).ToCoin(),
+		WithdrawalTimeLimit: cfg.WithdrawalTimeLimit,
+		SentToday:           calculateAmountSentToday().ToCoin(),
+		ReturnedToday:       returnedToday.ToCoin(),
+		ReturnedTotal:       returnedTotal.ToCoin(),
+		FeesToday:           state.feesSince(time.Now().Add(-time.Hour * 24)).ToCoin(),
+		FeesTotal:           state.feesSince(time.Time{}).ToCoin(),
+		Paused:              state.isPaused(),
+		DryRun:              cfg.DryRun,
+		QueueDepth:          payouts.depth(),
+	}
+	return resp
 }
 
 // requestFunds is the handler for HTTP POST requests to "/requestfaucet".
@@ -75,119 +195,515 @@ func requestFunds(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		sendReply(w, r, "", err.Error())
+		sendReply(w, r, "", err)
 		return
 	}
 
-	addressInput := r.FormValue("address")
-	amountInput := r.FormValue("amount")
-	overridetokenInput := r.FormValue("overridetoken")
+	req := &payRequest{
+		hostIP:         hostIP,
+		address:        r.FormValue("address"),
+		amount:         r.FormValue("amount"),
+		amountAtoms:    r.FormValue("amount_atoms"),
+		tier:           r.FormValue("tier"),
+		overrideToken:  r.FormValue("overridetoken"),
+		idempotencyKey: r.Header.Get(idempotencyKeyHeader),
+		staking:        r.FormValue("staking"),
+		purpose:        strings.TrimSpace(r.FormValue("purpose")),
+	}
+	if s := auth.session(r); s != nil {
+		req.subject = s.Subject
+	}
+	if req.apiKey, err = apiKeys.authenticate(r); err != nil {
+		log.Debugf("ip %v presented an invalid API key", hostIP)
+		writeJSONError(w, r, http.StatusUnauthorized, err)
+		return
+	}
+	if req.idempotencyKey == "" {
+		req.idempotencyKey = r.FormValue("idempotencykey")
+	}
 
-	resp, err := pay(r.Context(), hostIP, addressInput, amountInput, overridetokenInput)
+	// Refuse requests which cannot be paid before they are queued.
+	if err := checkPayout(r.Context(), req); err != nil {
+		sendReply(w, r, "", err)
+		return
+	}
+	if req.apiKey != "" {
+		apiKeys.recordUsage(req.apiKey, 0)
+	}
+	job, err := payouts.submit(req, requestSessionID(r))
 	if err != nil {
-		sendReply(w, r, "", err.Error())
+		// Requests refused by the queue are audited like those
+		// refused by checkPayout.
+		amount, _ := parseAmountInputs(req.amount, req.amountAtoms)
+		audit.record(newAuditEntry(req), amount, 0, "", err)
+		sendReply(w, r, "", err)
+		return
+	}
+
+	// API clients which opt in poll the status of the request instead of
+	// waiting for the payout.
+	if r.FormValue("json") != "" && r.FormValue("async") != "" {
+		w.Header().Set("Location", "/requeststatus/"+job.id)
+		writeJSON(w, http.StatusAccepted,
+			payouts.jobStatus(job, requestLanguage(r)))
 		return
 	}
-	sendReply(w, r, resp, "")
+	select {
+	case <-job.done:
+	case <-r.Context().Done():
+		return
+	}
+	txid, err := payouts.result(job)
+	sendReply(w, r, txid, err)
 }
 
-// pay uses the provided request parameters to process a faucet payment. It will
-// return an error if parameters are invalid or if the client has exceeded the
-// rate limit. Note: requestMtx is used to ensure only one pay function can run
-// at a time.
-func pay(ctx context.Context, hostIP, addressInput, amountInput, overridetokenInput string) (string, error) {
-	// Ensure only one pay function request can run at a time.
-	requestMtx.Lock()
-	defer requestMtx.Unlock()
+// requestStatusHandler is the handler for HTTP GET requests to
+// "/requeststatus/{id}".  It reports whether a payout request is queued, sent
+// or failed.
+func requestStatusHandler(w http.ResponseWriter, r *http.Request) {
+	st, ok := payouts.status(mux.Vars(r)["id"], requestLanguage(r))
+	if !ok {
+		writeJSONError(w, r, http.StatusNotFound,
+			newFaucetError(errCodeUnknownRequest))
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+// writeJSON writes v as the JSON reply with the provided status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("failed to write reply: %v", err)
+	}
+}
+
+// writeJSONError writes err, described in the language of r, as the JSON
+// reply with the provided status code.
+func writeJSONError(w http.ResponseWriter, r *http.Request, code int, err error) {
+	errCode, msg := localizeError(err, requestLanguage(r))
+	writeJSON(w, code, &jsonResponse{Error: msg, Code: errCode})
+}
+
+// idempotencyKeyHeader is the HTTP header carrying the idempotency key of a
+// payout request.  The idempotencykey form value may be used instead.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLen is the maximum length of an idempotency key.
+const maxIdempotencyKeyLen = 255
+
+// maxPurposeLen is the maximum length in characters of the purpose of a
+// payout.
+const maxPurposeLen = 100
+
+// payRequest holds the parameters of a payout request as submitted by the
+// client.
+type payRequest struct {
+	hostIP         string
+	address        string
+	amount         string
+	amountAtoms    string
+	tier           string
+	overrideToken  string
+	idempotencyKey string
+
+	// subject identifies the logged in user, if any.
+	subject string
+
+	// apiKey is the ID of the API key which authenticated the request, if
+	// any.
+	apiKey string
+
+	// purpose is the optional purpose of the payout given by the
+	// requester, such as "testing dcrdex".
+	purpose string
+
+	// requestID is the faucet generated ID of the request, assigned when
+	// it is queued.
+	requestID string
+
+	// cooldownKey is the cooldown the request is subject to, if any.  It
+	// is set by checkPayout so that a client can only queue one request
+	// per cooldown.
+	cooldownKey string
+
+	// addressChecked is set once the address passed checkAddressPolicy,
+	// so that the wallets are not asked to validate it again when the
+	// queued request is paid.
+	addressChecked bool
+
+	// staking is the staking mode of the request.  In staking mode the
+	// address is the voting address of the purchased ticket, or is sent
+	// the ticket price.
+	staking string
+
+	// recipients are the recipients of a bulk request.  It is nil for
+	// other requests.
+	recipients []bulkRecipient
+}
+
+// sameParams returns whether o asks for the same payout as req.
+func (req *payRequest) sameParams(o *payRequest) bool {
+	if len(req.recipients) != len(o.recipients) {
+		return false
+	}
+	for i := range req.recipients {
+		if req.recipients[i] != o.recipients[i] {
+			return false
+		}
+	}
+	return req.address == o.address && req.amount == o.amount &&
+		req.amountAtoms == o.amountAtoms && req.tier == o.tier &&
+		req.staking == o.staking
+}
+
+// idempotencyScope returns the idempotency key of req scoped to its client.
+func (req *payRequest) idempotencyScope() string {
+	return idempotencyScope(req.idempotencyKey, req.hostIP, req.subject,
+		req.apiKey)
+}
+
+// replayPayout returns the payout previously made for the idempotency key of
+// req, if any.  An error is returned when the key was used for a request with
+// different parameters.
+func replayPayout(req *payRequest, amount dcrutil.Amount, amountSpecified bool) (*payoutRecord, error) {
+	p, ok := state.payoutByIdempotencyKey(req.idempotencyScope())
+	if !ok {
+		return nil, nil
+	}
+	if p.Address != req.address ||
+		(amountSpecified && p.Amount != amount) ||
+		(req.tier != "" && p.Tier != req.tier) {
+		return nil, newFaucetError(errCodeIdempotencyKeyReused,
+			req.idempotencyKey)
+	}
+	return &p, nil
+}
+
+// payout is a payout request which passed all checks and may be sent.
+type payout struct {
+	// replay is the earlier payout repeated by the request, if any.
+	replay *payoutRecord
+
+	amount  dcrutil.Amount
+	tier    *payoutTier
+	key     *apiKey
+	address stdaddr.Address
+
+	// wallet is the wallet staking requests are served by.
+	wallet *walletBackend
+}
+
+// newAuditEntry returns the audit entry recording the outcome of req.
+func newAuditEntry(req *payRequest) *auditEntry {
+	return &auditEntry{
+		Time:             time.Now(),
+		IP:               req.hostIP,
+		Address:          req.address,
+		AmountInput:      req.amount,
+		AmountAtomsInput: req.amountAtoms,
+		Tier:             req.tier,
+		Subject:          req.subject,
+		APIKey:           req.apiKey,
+		IdempotencyKey:   req.idempotencyKey,
+		RequestID:        req.requestID,
+		Purpose:          req.purpose,
+	}
+}
+
+// checkPayout validates req before it is queued, so that requests which
+// cannot be paid, such as those of rate limited clients, are refused right
+// away and never take a place in the payout queue.  Refused requests are
+// recorded in the audit log.  Requests which pass are checked again by pay
+// when they are sent.
+func checkPayout(ctx context.Context, req *payRequest) error {
+	entry := newAuditEntry(req)
+	p, err := preparePayout(ctx, req, entry)
+	if err != nil {
+		audit.record(entry, p.amount, 0, "", err)
+		return err
+	}
+	if p.replay == nil && p.key == nil && entry.Token == "" {
+		req.cooldownKey = cooldownKey(p.tier.Name,
+			clientID(p.tier, req.hostIP, req.subject))
+	}
+	return nil
+}
+
+// preparePayout checks the parameters of req against the state of the faucet
+// and the limits of the client.  The returned payout holds the amount as far
+// as it is known even when an error is returned.
+func preparePayout(ctx context.Context, req *payRequest, entry *auditEntry) (*payout, error) {
+	hostIP, addressInput := req.hostIP, req.address
+	p := new(payout)
+
+	if len(req.idempotencyKey) > maxIdempotencyKeyLen {
+		return p, newFaucetError(errCodeIdempotencyKeyLength,
+			maxIdempotencyKeyLen)
+	}
+	if err := validatePurpose(req.purpose); err != nil {
+		return p, err
+	}
+
+	// check amount if specified
+	amount, err := parseAmountInputs(req.amount, req.amountAtoms)
+	if err != nil {
+		return p, err
+	}
+	p.amount = amount
+	amountSpecified := req.amount != "" || req.amountAtoms != ""
+
+	// Return the original payout of a repeated request rather than
+	// paying again.  This is checked before any limits so that a retry
+	// never hides the txid behind a rate limit error.
+	if req.idempotencyKey != "" {
+		replay, err := replayPayout(req, amount, amountSpecified)
+		if err != nil {
+			return p, err
+		}
+		if replay != nil {
+			p.replay = replay
+			return p, nil
+		}
+	}
 
 	amountMtx.RLock()
 	tLimit := transactionLimit
 	amountMtx.RUnlock()
 
-	var amount dcrutil.Amount
-	if cfg.withdrawalAmount > tLimit {
-		amount = tLimit
-	} else {
-		amount = cfg.withdrawalAmount
+	if state.isPaused() {
+		return p, newFaucetError(errCodePaused)
 	}
 
-	// enforce ratelimit unless overridetoken was specified and matches
-	if overridetokenInput != cfg.OverrideToken {
-		lastRequestTime, found := requestIPs[hostIP]
-		if found {
-			nextAllowedRequest := lastRequestTime.Add(cfg.withdrawalTimeLimit)
-			coolDownTime := time.Until(nextAllowedRequest)
+	if state.isBlocked(addressInput) {
+		log.Debugf("request for blocked address %s (ip: %s)",
+			addressInput, hostIP)
+		return p, newFaucetError(errCodeAddressBlocked, addressInput)
+	}
 
-			if coolDownTime >= 0 {
-				log.Debugf("client exceeded rate limit(ip: %s, address: %s)", hostIP, addressInput)
-				return "", fmt.Errorf("You may only withdraw %v DCR every "+
-					"%v seconds.  Please wait another %d seconds.",
-					cfg.WithdrawalAmount, cfg.WithdrawalTimeLimit, int(coolDownTime.Seconds()))
-			}
+	// Requests authenticated with an API key are limited by the key rather
+	// than the cooldown of the client.
+	if req.apiKey != "" {
+		k, ok := apiKeys.get(req.apiKey)
+		if !ok || k.revoked() {
+			return p, newFaucetError(errCodeInvalidAPIKey)
 		}
+		p.key = &k
 	}
 
-	// check amount if specified
-	if amountInput != "" {
-		amountFloat, err := strconv.ParseFloat(amountInput, 32)
-		if err != nil {
-			return "", fmt.Errorf("amount invalid: %v", err)
+	// Staking requests have their own limits.
+	if req.staking != "" {
+		return p, prepareStake(ctx, req, entry, p)
+	}
+
+	// Select the payout tier, either by name or by the requested amount.
+	tier, err := selectTier(req.tier, amount, req.subject != "")
+	if err != nil {
+		return p, err
+	}
+	p.tier = tier
+	entry.Tier = tier.Name
+	if !amountSpecified {
+		amount = effectiveAmount(tier, tLimit)
+		if p.key != nil && p.key.MaxAmount > 0 {
+			amount = minAmount(amount, p.key.MaxAmount)
+		}
+		p.amount = amount
+	}
 
+	// enforce the limits of the API key, or otherwise the ratelimit
+	// unless overridetoken was specified and matches
+	switch {
+	case p.key != nil:
+		if err := checkAPIKeyLimits(p.key, amount); err != nil {
+			log.Debugf("API key %s exceeded its limits: %v", p.key.ID,
+				err)
+			return p, err
 		}
-		amount, err = dcrutil.NewAmount(amountFloat)
-		if err != nil {
-			return "", fmt.Errorf("NewAmount failed: %v", err)
+	case req.overrideToken == cfg.OverrideToken:
+		entry.Token = tokenOverride
+	default:
+		lastRequestTime, found := state.lastRequest(tier.Name,
+			clientID(tier, hostIP, req.subject))
+		if found {
+			nextAllowedRequest := lastRequestTime.Add(tier.Cooldown)
+			coolDownTime := time.Until(nextAllowedRequest)
+
+			if coolDownTime >= 0 {
+				log.Debugf("client exceeded rate limit(ip: %s, address: %s, tier: %s)",
+					hostIP, addressInput, tier.Name)
+				return p, newFaucetError(errCodeRateLimited,
+					tier.Amount, int64(tier.Cooldown.Seconds()),
+					tier.Name, int(coolDownTime.Seconds()))
+			}
 		}
 	}
 
 	if amount <= 0 {
-		return "", errors.New("amount must be greater than 0")
+		return p, newFaucetError(errCodeAmountNotPositive)
+	}
+
+	// enforce the limits of the tier
+	if amount > tier.Amount {
+		return p, newFaucetError(errCodeAmountExceedsTier, tier.Amount,
+			tier.Name)
+	}
+	if tier.Budget > 0 {
+		sent := state.sentSince(time.Now().Add(-time.Hour*24), tier.Name)
+		if sent+amount > tier.Budget {
+			log.Debugf("daily budget of tier %s exhausted (sent %v of %v)",
+				tier.Name, sent, tier.Budget)
+			return p, newFaucetError(errCodeTierBudgetExhausted,
+				tier.Name)
+		}
 	}
 
 	// enforce the transaction limit unconditionally
 	if amount > tLimit {
-		return "", errors.New("amount exceeds limit")
+		return p, newFaucetError(errCodeAmountExceedsLimit)
 	}
 
-	// Decode address and amount and send transaction.
-	address, err := stdaddr.DecodeAddress(addressInput, activeNetParams.Params)
+	// Decode address.
+	p.address, err = stdaddr.DecodeAddress(addressInput, activeNetParams.Params)
+	if err != nil {
+		log.Errorf("ip %v submitted bad address %v: %v", hostIP,
+			addressInput, err)
+		return p, newFaucetError(errCodeInvalidAddress, addressInput)
+	}
+	if !req.addressChecked {
+		if err := checkAddressPolicy(ctx, p.address, false); err != nil {
+			log.Debugf("ip %v submitted refused address %v: %v",
+				hostIP, addressInput, err)
+			return p, err
+		}
+		req.addressChecked = true
+	}
+	return p, nil
+}
+
+// pay uses the provided request parameters to process a faucet payment. It will
+// return an error if parameters are invalid or if the client has exceeded the
+// rate limit. A request repeating the idempotency key of an earlier payout
+// returns the original txid instead of paying again. Every request is recorded
+// in the audit log. Note: requestMtx is used to ensure only one pay function
+// can run at a time.
+func pay(ctx context.Context, req *payRequest) (txid string, err error) {
+	hostIP, addressInput := req.hostIP, req.address
+
+	// Record the outcome of every request in the audit log.
+	var amount, granted dcrutil.Amount
+	entry := newAuditEntry(req)
+	defer func() {
+		audit.record(entry, amount, granted, txid, err)
+	}()
+
+	// Ensure only one pay function request can run at a time.
+	requestMtx.Lock()
+	defer requestMtx.Unlock()
+
+	p, err := preparePayout(ctx, req, entry)
+	amount = p.amount
 	if err != nil {
-		log.Errorf("ip %v submitted bad address %v", hostIP, addressInput)
 		return "", err
 	}
+	if p.replay != nil {
+		log.Infof("replaying payout %v to %v for %v (idempotency "+
+			"key %q)", p.replay.TxID, p.replay.Address, hostIP,
+			req.idempotencyKey)
+		entry.Decision = decisionReplayed
+		entry.Tier = p.replay.Tier
+		return p.replay.TxID, nil
+	}
+	if req.staking != "" {
+		txid, err = stake(ctx, req, entry, p)
+		if err == nil {
+			granted = amount
+		}
+		return txid, err
+	}
+	address, tier, key := p.address, p.tier, p.key
 
-	resp, err := dcrwClient.SendFromMinConf(ctx, cfg.WalletAccount, address, amount, 0)
+	// Spend only confirmed outputs when the UTXO pool is maintained so that
+	// payouts do not chain on unconfirmed change, unless none are left.
+	minConf := 0
+	if cfg.UTXOPoolSize > 0 {
+		minConf = 1
+	}
+	memo := payoutMemo(req)
+	resp, wallet, fee, err := wallets.sendFrom(ctx, address, amount, minConf,
+		memo)
+	if minConf > 0 && isInsufficientFundsError(err) {
+		log.Debugf("no confirmed outputs available for %v, spending "+
+			"unconfirmed outputs", address)
+		minConf = 0
+		resp, wallet, fee, err = wallets.sendFrom(ctx, address, amount,
+			minConf, memo)
+	}
 	if err != nil {
 		log.Errorf("error sending %v to %v for %v: %v",
 			amount, address, hostIP, err)
-		return "", err
+		entry.Decision = decisionFailed
+		switch {
+		case errors.Is(err, errNoWallet):
+			return "", err
+		case isInsufficientFundsError(err):
+			updateBalance()
+			return "", insufficientFundsError(amount, minConf)
+		}
+		return "", newFaucetError(errCodePayoutFailed, err)
 	}
 
-	requestAmounts[time.Now()] = amount
-	requestIPs[hostIP] = time.Now()
-	log.Infof("successfully sent %v to %v for %v",
-		amount, address, hostIP)
-	updateBalance(dcrwClient)
+	if cfg.DryRun {
+		log.Infof("simulated sending %v to %v for %v from wallet %v "+
+			"(fee %v)", amount, address, hostIP, wallet, fee)
+		entry.Simulated = true
+	} else {
+		recordFee(fee)
+		log.Infof("successfully sent %v to %v for %v from wallet %v "+
+			"(fee %v)", amount, address, hostIP, wallet, fee)
+	}
+	err = state.addPayout(payoutRecord{
+		TxID:    resp.String(),
+		Time:    time.Now(),
+		IP:      hostIP,
+		Address: addressInput,
+		Amount:  amount,
+		Tier:    tier.Name,
+		Token:   entry.Token,
+		Subject: req.subject,
+
+		IdempotencyKey: req.idempotencyKey,
+		APIKey:         req.apiKey,
+		Wallet:         wallet.String(),
+		Fee:            fee,
+		RequestID:      req.requestID,
+		Purpose:        req.purpose,
+		Simulated:      cfg.DryRun,
+	})
+	if err != nil {
+		// The coins were sent, so only log the failure.
+		log.Errorf("failed to record payout %v: %v", resp, err)
+	}
+	if key != nil && !cfg.DryRun {
+		apiKeys.recordUsage(key.ID, amount)
+	}
+	history.addPayout(time.Now(), amount)
+	publishPayout(resp.String(), amount, addressInput, tier.Name)
+	updateBalance()
 
+	granted = amount
 	return resp.String(), nil
 }
 
-func calculateAmountSentToday() dcrutil.Amount {
-	defer requestMtx.RUnlock()
-	requestMtx.RLock()
-
-	var amountToday dcrutil.Amount
-
-	now := time.Now()
-	for then, amount := range requestAmounts {
-		if now.Sub(then) >= time.Hour*24 {
-			continue
-		}
-
-		amountToday += amount
-	}
+// effectiveAmount returns the amount sent for a request in tier which does not
+// specify an amount given the current transaction limit.
+func effectiveAmount(tier *payoutTier, tLimit dcrutil.Amount) dcrutil.Amount {
+	return minAmount(tier.Amount, tLimit)
+}
 
-	return amountToday
+func calculateAmountSentToday() dcrutil.Amount {
+	return state.sentSince(time.Now().Add(-time.Hour*24), "")
 }
 
 func main() {
@@ -199,54 +715,79 @@ func main() {
 	}
 
 	cfg = loadedCfg
+	log.Infof("Using transaction limit policy: %v", cfg.limitPolicy)
 
 	quit := make(chan struct{})
-	requestAmounts = make(map[time.Time]dcrutil.Amount)
-	requestIPs = make(map[string]time.Time)
 
-	dcrwCerts, err := os.ReadFile(cfg.WalletCert)
+	// Keep simulated payouts apart from the real payout history.
+	stateDir := cfg.DataDir
+	if cfg.DryRun {
+		stateDir = filepath.Join(cfg.DataDir, dryRunDirname)
+		log.Warnf("Dry-run mode: payouts are signed but not broadcast "+
+			"and recorded in %s", stateDir)
+	}
+	state, err = openStateStore(stateDir)
 	if err != nil {
-		log.Errorf("Failed to read dcrwallet cert file at %s: %s", cfg.WalletCert,
-			err.Error())
+		log.Errorf("Failed to open faucet state in %s: %v", stateDir, err)
 		os.Exit(1)
 	}
-	log.Infof("Attempting to connect to dcrwallet RPC %s as user %s "+
-		"using certificate located in %s",
-		cfg.WalletHost, cfg.WalletUser, cfg.WalletCert)
-	connCfgDaemon := &rpcclient.ConnConfig{
-		Host:         cfg.WalletHost,
-		Endpoint:     "ws",
-		User:         cfg.WalletUser,
-		Pass:         cfg.WalletPassword,
-		Certificates: dcrwCerts,
-		DisableTLS:   false,
-	}
-	rpcClient, err := rpcclient.New(connCfgDaemon, nil)
+	history.load(state)
+	if !cfg.DryRun {
+		metricPayoutFees.Set(int64(state.feesSince(time.Time{})))
+	}
+
+	apiKeys, err = openAPIKeyStore(cfg.DataDir)
 	if err != nil {
-		log.Errorf("Failed to start dcrwallet rpcclient: %s", err.Error())
+		log.Errorf("Failed to open API keys in %s: %v", cfg.DataDir, err)
 		os.Exit(1)
 	}
-	dcrwClient = dcrwallet.NewClient(dcrwallet.RawRequestCaller(rpcClient), chaincfg.TestNet3Params())
 
-	go func() {
-		timer := time.NewTicker(5 * time.Minute)
-		defer timer.Stop()
-
-		updateBalance(dcrwClient)
-		for {
-			select {
-			case <-quit:
-				return
-			case <-timer.C:
-				updateBalance(dcrwClient)
-			}
+	if cfg.OIDCIssuer != "" {
+		auth, err = newAuthenticator(context.Background(), cfg)
+		if err != nil {
+			log.Errorf("Failed to set up login: %v", err)
+			os.Exit(1)
 		}
-	}()
-	go func() {
-		<-quit
-		log.Info("Closing testnetfaucet.")
-		rpcClient.Disconnect()
+		log.Infof("Users may log in with %s", cfg.OIDCIssuer)
+	}
+
+	wallets, err = connectWallets(context.Background(), cfg.walletEndpoints)
+	if err != nil {
+		log.Errorf("Failed to start dcrwallet rpcclient: %v", err)
 		os.Exit(1)
+	}
+	wallets.checkHealth(context.Background())
+	go wallets.monitor(quit)
+	dcrwClient := wallets.primary()
+
+	err = validateReturnAddress(context.Background(), dcrwClient, cfg.WalletAddress)
+	if err != nil {
+		log.Errorf("Invalid return address: %v", err)
+		os.Exit(1)
+	}
+	if cfg.RotateReturnAddress {
+		returnAddrs = newReturnAddressIssuer(dcrwClient,
+			dcrwallet.GapPolicy(cfg.ReturnAddrGapPolicy))
+	}
+	returns = newReturnsTracker(dcrwClient, cfg.WalletAddress)
+
+	// Refresh the balance whenever the primary wallet sees a new block,
+	// and periodically to cover unconfirmed transactions.
+	go balanceUpdater(quit)
+	go pollBestBlock(quit)
+	go apiKeys.run(quit)
+	if cfg.UTXOPoolSize > 0 && !cfg.DryRun {
+		pool := newUTXOPool(dcrwClient, cfg.UTXOPoolSize, cfg.utxoPoolAmount)
+		go pool.run(quit)
+	}
+	payouts = newPayoutQueue(cfg.PayoutQueueSize)
+
+	// Shut down on interrupt.
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		close(quit)
 	}()
 
 	r := mux.NewRouter()
@@ -258,30 +799,81 @@ func main() {
 
 	// The /requestfaucet endpoint is used by Pi and CMS
 	r.HandleFunc("/requestfaucet", requestFunds).Methods("POST")
+	r.HandleFunc("/requestfaucet/bulk", requestBulk).Methods("POST")
+	r.HandleFunc("/requeststatus/{id}", requestStatusHandler).Methods("GET")
+	r.HandleFunc("/status", status).Methods("GET")
+	r.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	r.HandleFunc("/events", eventsHandler).Methods("GET")
+	r.HandleFunc("/history", historyHandler).Methods("GET")
+	if auth != nil {
+		r.HandleFunc("/auth/login", auth.handleLogin).Methods("GET")
+		r.HandleFunc("/auth/callback", auth.handleCallback).Methods("GET")
+		r.HandleFunc("/auth/logout", auth.handleLogout).Methods("POST")
+	}
 	r.HandleFunc("/", index).Methods("GET")
 
+	// The admin API is served on a separate listener which should not be
+	// exposed publicly.
+	if cfg.AdminListen != "" {
+		go func() {
+			log.Infof("Serving admin API on %s", cfg.AdminListen)
+			err := http.ListenAndServe(cfg.AdminListen, adminRouter())
+			if err != nil {
+				log.Errorf("Failed to bind admin http server: %v", err)
+			}
+		}()
+	}
+
 	// CORS options
 	origins := handlers.AllowedOrigins([]string{"*"})
 	methods := handlers.AllowedMethods([]string{"GET", "OPTIONS", "POST"})
-	headers := handlers.AllowedHeaders([]string{"Content-Type"})
+	headers := handlers.AllowedHeaders([]string{"Content-Type",
+		"Authorization", idempotencyKeyHeader})
+	exposed := handlers.ExposedHeaders([]string{"Location"})
 
-	err = http.ListenAndServe(cfg.Listen,
-		handlers.CORS(origins, methods, headers)(r))
-	if err != nil {
+	srv := &http.Server{
+		Addr:    cfg.Listen,
+		Handler: handlers.CORS(origins, methods, headers, exposed)(r),
+	}
+	srv.RegisterOnShutdown(events.close)
+	go func() {
+		<-quit
+		log.Info("Closing testnetfaucet.")
+		if err := srv.Shutdown(context.Background()); err != nil {
+			log.Errorf("Failed to shut down http server: %v", err)
+		}
+	}()
+	err = srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Errorf("Failed to bind http server: %s", err.Error())
 	}
+
+	// Send the queued payouts before disconnecting from the wallets.
+	payouts.drain()
+	apiKeys.flush()
+	audit.close()
+	wallets.disconnect()
+	state.close()
 }
 
-func sendReply(w http.ResponseWriter, r *http.Request, successMsg string, errMsg string) {
+// sendReply writes the page, or the JSON reply when requested, reporting the
+// txid of a successful payout or the error of a failed request.  Text is
+// translated into the language of the request.
+func sendReply(w http.ResponseWriter, r *http.Request, successMsg string, replyErr error) {
 	w.Header().Set("X-Frame-Options", "DENY")
 	w.Header().Set("X-XSS-Protection", "1; mode=block")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("Referrer-Policy", "no-referrer")
 
+	lang := requestLanguage(r)
 	jsonResp := &jsonResponse{
-		Error: errMsg,
-		TxID:  successMsg,
+		TxID:      successMsg,
+		Simulated: cfg.DryRun && successMsg != "",
+	}
+	if replyErr != nil {
+		jsonResp.Code, jsonResp.Error = localizeError(replyErr, lang)
 	}
+	w.Header().Set("Content-Language", lang)
 	json, err := json.Marshal(jsonResp)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -303,19 +895,61 @@ func sendReply(w http.ResponseWriter, r *http.Request, successMsg string, errMsg
 	tLimit := transactionLimit
 	amountMtx.RUnlock()
 
+	returnAddress := cfg.WalletAddress
+	if returnAddrs != nil {
+		if addr, ok := returnAddrs.addressFor(sessionID(w, r)); ok {
+			returnAddress = addr
+		}
+	}
+
+	user := auth.session(r)
+	available := availableTiers(user != nil)
+	tiers := make([]tierInfo, 0, len(available))
+	for _, t := range available {
+		tiers = append(tiers, tierInfo{
+			Name:     t.Name,
+			Amount:   effectiveAmount(t, tLimit),
+			Cooldown: t.Cooldown,
+		})
+	}
+
+	returnedToday, returnedTotal := returns.totals()
 	info := &testnetFaucetInfo{
-		Address:          cfg.WalletAddress,
+		Address:          returnAddress,
 		Amount:           cfg.withdrawalAmount,
-		Balance:          balance,
+		Balance:          balance.available(),
+		Balances:         balance,
 		TransactionLimit: tLimit,
 		TimeLimit:        cfg.withdrawalTimeLimit,
 		SentToday:        calculateAmountSentToday(),
+		ReturnedToday:    returnedToday,
+		ReturnedTotal:    returnedTotal,
+		TopReturners:     returns.topReturners(),
+		Paused:           state.isPaused(),
+		Tiers:            tiers,
 		Success:          successMsg,
-		Error:            errMsg,
+		Error:            jsonResp.Error,
+		Lang:             lang,
+		Languages:        languages(),
+		LoginEnabled:     auth != nil,
+		Staking:          cfg.stakingTier != nil,
+		Simulated:        jsonResp.Simulated,
+	}
+	if len(tiers) > 0 {
+		info.EffectiveAmount = tiers[0].Amount
+		info.TimeLimit = tiers[0].Cooldown
+	}
+	if user != nil {
+		info.User = user.Name
 	}
 
 	fp := filepath.Join("public/views", "design_sketch.html")
-	tmpl, err := template.New("home").ParseFiles(fp)
+	funcs := template.FuncMap{
+		"T": func(key string, args ...interface{}) string {
+			return translate(lang, key, args...)
+		},
+	}
+	tmpl, err := template.New("home").Funcs(funcs).ParseFiles(fp)
 	if err != nil {
 		panic(err)
 	}
@@ -343,31 +977,3 @@ func getClientIP(r *http.Request) (string, error) {
 
 	return xRealIP, nil
 }
-
-func updateBalance(c *dcrwallet.Client) {
-	// Use background context here, rather than a request context, because
-	// updateBalance should always succeed after a payout, even if the request
-	// context has been closed (eg. because client has closed their connection).
-	gbr, err := c.GetBalanceMinConf(context.Background(), cfg.WalletAccount, 0)
-	if err != nil {
-		log.Warnf("unable to update balance: %v", err)
-		return
-	}
-
-	var spendable dcrutil.Amount
-	for _, balance := range gbr.Balances {
-		bal, err := dcrutil.NewAmount(balance.Spendable)
-		if err != nil {
-			log.Warnf("NewAmount error: %v", err)
-			continue
-		}
-		spendable += bal
-	}
-
-	amountMtx.Lock()
-	log.Infof("updating balance from %v to %v", lastBalance, spendable)
-	lastBalance = spendable
-	transactionLimit = spendable / 100
-	log.Infof("updating transaction limit to %v", transactionLimit)
-	amountMtx.Unlock()
-}
@@ -0,0 +1,54 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/decred/dcrd/txscript/v4/stdscript"
+)
+
+// memoPrefix starts the null-data memo of every payout so that faucet
+// transactions can be recognized on chain.
+const memoPrefix = "testnetfaucet "
+
+// maxMemoPurposeLen is the maximum length in bytes of the purpose of a payout
+// when it is committed in a memo, which also holds the prefix, the 32
+// character request ID and a separating space.
+const maxMemoPurposeLen = stdscript.MaxDataCarrierSizeV0 - len(memoPrefix) - 33
+
+// validatePurpose returns an error when the purpose of a payout is too long
+// or contains control characters.  With memooutput set, the purpose must also
+// fit in the memo output.
+func validatePurpose(purpose string) error {
+	if utf8.RuneCountInString(purpose) > maxPurposeLen {
+		return newFaucetError(errCodePurposeTooLong, maxPurposeLen)
+	}
+	if cfg.MemoOutput && len(purpose) > maxMemoPurposeLen {
+		return newFaucetError(errCodePurposeTooLongBytes,
+			maxMemoPurposeLen)
+	}
+	for _, r := range purpose {
+		if !unicode.IsPrint(r) {
+			return newFaucetError(errCodePurposeInvalid)
+		}
+	}
+	return nil
+}
+
+// payoutMemo returns the memo committed in a null-data output of the payout
+// for req, which holds the request ID and purpose.  It is nil unless
+// memooutput is set.
+func payoutMemo(req *payRequest) []byte {
+	if !cfg.MemoOutput {
+		return nil
+	}
+	memo := memoPrefix + req.requestID
+	if req.purpose != "" {
+		memo += " " + req.purpose
+	}
+	return []byte(memo)
+}
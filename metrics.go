@@ -0,0 +1,57 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+)
+
+// metrics holds all exported faucet metrics.  A dedicated map is used rather
+// than the global expvar handler so that unrelated variables such as the
+// command line, which may contain the wallet password, are never exposed.
+var metrics = expvar.NewMap("testnetfaucet")
+
+// UTXO pool metrics.
+var (
+	metricUTXOPoolOutputs      = newMetricInt("utxopool_outputs")
+	metricUTXOPoolSplits       = newMetricInt("utxopool_splits")
+	metricUTXOPoolSplitOutputs = newMetricInt("utxopool_split_outputs")
+	metricUTXOPoolSplitErrors  = newMetricInt("utxopool_split_errors")
+)
+
+// Payout queue metrics.
+var (
+	metricPayoutQueueDepth    = newMetricInt("payoutqueue_depth")
+	metricPayoutQueueRejected = newMetricInt("payoutqueue_rejected")
+)
+
+// Live event metrics.
+var (
+	metricEventSubscribers = newMetricInt("events_subscribers")
+	metricEventsDropped    = newMetricInt("events_dropped")
+)
+
+// Fee metrics.  The total is in atoms and includes the payouts of previous
+// runs.
+var metricPayoutFees = newMetricInt("payout_fees_atoms")
+
+// Wallet metrics.
+var metricWalletsHealthy = newMetricInt("wallets_healthy")
+
+// newMetricInt creates a new integer metric and registers it under name.
+func newMetricInt(name string) *expvar.Int {
+	v := new(expvar.Int)
+	metrics.Set(name, v)
+	return v
+}
+
+// metricsHandler is the handler for HTTP GET requests to "/metrics".  It
+// returns all metrics as a JSON object.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, metrics.String())
+}
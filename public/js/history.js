@@ -0,0 +1,95 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// history.js renders charts of the payouts and balance of the faucet from the
+// aggregates served at /history.
+(function () {
+  'use strict';
+
+  var container = document.getElementById('history');
+  if (!container || !window.Chart || !window.XMLHttpRequest) {
+    return;
+  }
+
+  Chart.defaults.global.defaultFontColor = '#FFFFFF';
+
+  var charts = {};
+
+  // label formats the start of a bucket for the x axis.  Daily buckets show
+  // the date and hourly buckets the time, along with the date at midnight.
+  function label(time, interval) {
+    var d = new Date(time);
+    if (interval >= 86400) {
+      return d.toLocaleDateString();
+    }
+    var hhmm = ('0' + d.getHours()).slice(-2) + ':' +
+      ('0' + d.getMinutes()).slice(-2);
+    if (d.getHours() === 0) {
+      return d.toLocaleDateString() + ' ' + hhmm;
+    }
+    return hhmm;
+  }
+
+  function render(id, type, title, labels, data, color) {
+    if (charts[id]) {
+      charts[id].destroy();
+    }
+    charts[id] = new Chart(document.getElementById(id), {
+      type: type,
+      data: {
+        labels: labels,
+        datasets: [{
+          label: title,
+          data: data,
+          backgroundColor: color,
+          borderColor: color,
+          fill: false
+        }]
+      },
+      options: {
+        animation: false,
+        scales: {
+          yAxes: [{ ticks: { beginAtZero: true } }]
+        }
+      }
+    });
+  }
+
+  function load(range) {
+    var req = new XMLHttpRequest();
+    req.open('GET', '/history?range=' + encodeURIComponent(range));
+    req.onload = function () {
+      if (req.status !== 200) {
+        return;
+      }
+      var resp = JSON.parse(req.responseText);
+      var labels = [], payouts = [], amounts = [], balances = [];
+      resp.buckets.forEach(function (b) {
+        labels.push(label(b.time, resp.interval));
+        payouts.push(b.payouts);
+        amounts.push(b.amount);
+        balances.push(b.balance);
+      });
+      render('chart-payouts', 'bar', container.getAttribute('data-label-payouts'),
+        labels, payouts, '#2ed6a1');
+      render('chart-amount', 'bar', container.getAttribute('data-label-amount'),
+        labels, amounts, '#2970ff');
+      render('chart-balance', 'line', container.getAttribute('data-label-balance'),
+        labels, balances, '#ffffff');
+    };
+    req.send();
+  }
+
+  var buttons = container.querySelectorAll('button[data-range]');
+  Array.prototype.forEach.call(buttons, function (button) {
+    button.addEventListener('click', function () {
+      Array.prototype.forEach.call(buttons, function (b) {
+        b.classList.toggle('active', b === button);
+      });
+      load(button.getAttribute('data-range'));
+    });
+  });
+
+  load('24h');
+})();
@@ -0,0 +1,86 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+// live.js keeps the faucet statistics up to date using the server-sent event
+// stream served at /events.
+(function () {
+  'use strict';
+
+  if (!window.EventSource) {
+    return;
+  }
+
+  // maxRecentPayouts is the number of payouts shown in the recent payouts
+  // table.
+  var maxRecentPayouts = 10;
+
+  function formatDCR(amount) {
+    return amount + ' DCR';
+  }
+
+  function setText(id, text) {
+    var el = document.getElementById(id);
+    if (el) {
+      el.textContent = text;
+    }
+  }
+
+  function onBalance(e) {
+    var data = JSON.parse(e.data);
+    setText('balance', formatDCR(data.balance.available));
+    setText('balance-spendable', formatDCR(data.balance.spendable));
+    setText('balance-unconfirmed', formatDCR(data.balance.unconfirmed));
+    setText('balance-immature', formatDCR(data.balance.immature));
+    setText('balance-lockedbytickets', formatDCR(data.balance.lockedbytickets));
+    setText('balance-votingauthority', formatDCR(data.balance.votingauthority));
+    setText('transactionlimit', formatDCR(data.transactionlimit));
+    setText('senttoday', formatDCR(data.senttoday));
+  }
+
+  function onPaused(e) {
+    var data = JSON.parse(e.data);
+    var el = document.getElementById('paused');
+    if (el) {
+      el.style.display = data.paused ? '' : 'none';
+    }
+  }
+
+  function onPayout(e) {
+    var data = JSON.parse(e.data);
+    var container = document.getElementById('recent-payouts');
+    if (!container) {
+      return;
+    }
+    var tbody = container.getElementsByTagName('tbody')[0];
+
+    var row = document.createElement('tr');
+    var cells = [
+      new Date(data.time).toLocaleTimeString(),
+      data.address,
+      formatDCR(data.amount)
+    ];
+    cells.forEach(function (text) {
+      var td = document.createElement('td');
+      td.textContent = text;
+      row.appendChild(td);
+    });
+    var td = document.createElement('td');
+    var a = document.createElement('a');
+    a.href = 'https://testnet.dcrdata.org/explorer/tx/' + encodeURIComponent(data.txid);
+    a.textContent = data.txid.substring(0, 16) + '...';
+    td.appendChild(a);
+    row.appendChild(td);
+
+    tbody.insertBefore(row, tbody.firstChild);
+    while (tbody.rows.length > maxRecentPayouts) {
+      tbody.deleteRow(tbody.rows.length - 1);
+    }
+    container.style.display = '';
+  }
+
+  var source = new EventSource('/events');
+  source.addEventListener('balance', onBalance);
+  source.addEventListener('paused', onPaused);
+  source.addEventListener('payout', onPayout);
+})();
@@ -0,0 +1,290 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Payout request states reported by the request status API.
+const (
+	requestQueued = "queued"
+	requestSent   = "sent"
+	requestFailed = "failed"
+)
+
+// requestRetention is how long the outcome of a processed payout request can
+// be queried.
+const requestRetention = time.Hour
+
+var (
+	// errQueueFull is returned when a request is submitted while the
+	// payout queue is full.
+	errQueueFull = newFaucetError(errCodeQueueFull)
+
+	// errQueueClosed is returned when a request is submitted while the
+	// faucet is shutting down.
+	errQueueClosed = newFaucetError(errCodeShuttingDown)
+
+	// errRequestPending is returned when a client submits a request while
+	// an earlier one subject to the same cooldown is still queued.
+	errRequestPending = newFaucetError(errCodeRequestPending)
+)
+
+// payoutJob is a payout request submitted to the payout queue.
+type payoutJob struct {
+	id      string
+	req     *payRequest
+	session string
+
+	// done is closed once the request was processed.
+	done chan struct{}
+
+	// The following fields are protected by the queue mutex.
+	status   string
+	txid     string
+	err      error
+	bulk     *bulkResponse
+	finished time.Time
+}
+
+// requestStatus is the JSON reply describing a payout request.
+type requestStatus struct {
+	RequestID string `json:"requestid"`
+	Status    string `json:"status"`
+	TxID      string `json:"txid,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+	Simulated bool   `json:"simulated,omitempty"`
+
+	// Bulk is the outcome of every recipient of a processed bulk request.
+	Bulk *bulkResponse `json:"bulk,omitempty"`
+}
+
+// payoutQueue hands payout requests to a single worker which sends them in
+// order, so that a slow wallet does not block the HTTP handlers.
+type payoutQueue struct {
+	jobs chan *payoutJob
+	wg   sync.WaitGroup
+
+	mtx    sync.Mutex
+	closed bool
+	byID   map[string]*payoutJob
+
+	// pending maps the idempotency keys of queued requests, as scoped by
+	// idempotencyScope, to their job so that a retry does not queue the
+	// payout twice.
+	pending map[string]*payoutJob
+
+	// cooldowns maps the cooldowns of queued requests to their job so that
+	// a client can not queue more than one request per cooldown.
+	cooldowns map[string]*payoutJob
+}
+
+// payouts is the queue of payout requests.  It is created in main.
+var payouts *payoutQueue
+
+// newPayoutQueue creates a payout queue holding at most size waiting requests
+// and starts its worker.
+func newPayoutQueue(size int) *payoutQueue {
+	q := &payoutQueue{
+		jobs:      make(chan *payoutJob, size),
+		byID:      make(map[string]*payoutJob),
+		pending:   make(map[string]*payoutJob),
+		cooldowns: make(map[string]*payoutJob),
+	}
+	q.wg.Add(1)
+	go q.worker()
+	return q
+}
+
+// worker sends the queued payouts until the queue is drained.
+func (q *payoutQueue) worker() {
+	defer q.wg.Done()
+
+	for job := range q.jobs {
+		metricPayoutQueueDepth.Add(-1)
+		if job.req.recipients != nil {
+			resp, err := payBulk(context.Background(), job.req)
+			q.finish(job, resp.TxID, err, resp)
+			continue
+		}
+		txid, err := pay(context.Background(), job.req)
+		if err == nil && returnAddrs != nil {
+			returnAddrs.bindPayout(context.Background(), job.session,
+				txid, job.req.address)
+		}
+		q.finish(job, txid, err, nil)
+	}
+}
+
+// finish records the outcome of job, along with the outcome of every recipient
+// of a bulk request, and forgets requests processed more than requestRetention
+// ago.
+func (q *payoutQueue) finish(job *payoutJob, txid string, err error, bulk *bulkResponse) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	now := time.Now()
+	job.status, job.txid, job.err = requestSent, txid, err
+	job.bulk = bulk
+	if err != nil {
+		job.status = requestFailed
+	}
+	job.finished = now
+	close(job.done)
+	if job.req.idempotencyKey != "" {
+		if key := job.req.idempotencyScope(); q.pending[key] == job {
+			delete(q.pending, key)
+		}
+	}
+	if q.cooldowns[job.req.cooldownKey] == job {
+		delete(q.cooldowns, job.req.cooldownKey)
+	}
+
+	for id, j := range q.byID {
+		if !j.finished.IsZero() && now.Sub(j.finished) > requestRetention {
+			delete(q.byID, id)
+		}
+	}
+}
+
+// submit queues a payout request which passed checkPayout.  A request
+// carrying the idempotency key of a request which is still queued returns the
+// queued job instead, unless its parameters differ.  A client may only have
+// one request queued per cooldown.
+func (q *payoutQueue) submit(req *payRequest, session string) (*payoutJob, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.closed {
+		return nil, errQueueClosed
+	}
+	if req.idempotencyKey != "" {
+		if job, ok := q.pending[req.idempotencyScope()]; ok {
+			if !job.req.sameParams(req) {
+				return nil, newFaucetError(errCodeIdempotencyKeyReused,
+					req.idempotencyKey)
+			}
+			return job, nil
+		}
+	}
+	if req.cooldownKey != "" {
+		if _, ok := q.cooldowns[req.cooldownKey]; ok {
+			return nil, errRequestPending
+		}
+	}
+
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	req.requestID = hex.EncodeToString(b[:])
+	job := &payoutJob{
+		id:      req.requestID,
+		req:     req,
+		session: session,
+		done:    make(chan struct{}),
+		status:  requestQueued,
+	}
+	select {
+	case q.jobs <- job:
+	default:
+		metricPayoutQueueRejected.Add(1)
+		return nil, errQueueFull
+	}
+	metricPayoutQueueDepth.Add(1)
+
+	q.byID[job.id] = job
+	if req.idempotencyKey != "" {
+		q.pending[req.idempotencyScope()] = job
+	}
+	if req.cooldownKey != "" {
+		q.cooldowns[req.cooldownKey] = job
+	}
+	return job, nil
+}
+
+// status returns the status of the request with the provided ID, with errors
+// described in lang.
+func (q *payoutQueue) status(id, lang string) (*requestStatus, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	job, ok := q.byID[id]
+	if !ok {
+		return nil, false
+	}
+	return job.statusLocked(lang), true
+}
+
+// jobStatus returns the status of job, with errors described in lang.
+func (q *payoutQueue) jobStatus(job *payoutJob, lang string) *requestStatus {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return job.statusLocked(lang)
+}
+
+// result returns the txid or error of a processed job.
+func (q *payoutQueue) result(job *payoutJob) (string, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return job.txid, job.err
+}
+
+// bulkResult returns the reply to a processed bulk request, with errors
+// described in lang.
+func (q *payoutQueue) bulkResult(job *payoutJob, lang string) *bulkResponse {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return job.bulk.localized(job.err, lang)
+}
+
+// statusLocked returns the status of the job with errors described in lang.
+// It must be called with the queue mutex held.
+func (job *payoutJob) statusLocked(lang string) *requestStatus {
+	st := &requestStatus{
+		RequestID: job.id,
+		Status:    job.status,
+		TxID:      job.txid,
+		Simulated: cfg.DryRun && job.txid != "",
+	}
+	if job.err != nil {
+		st.Code, st.Error = localizeError(job.err, lang)
+	}
+	if job.bulk != nil {
+		st.Bulk = job.bulk.localized(job.err, lang)
+	}
+	return st
+}
+
+// depth returns the number of requests waiting in the queue.
+func (q *payoutQueue) depth() int {
+	return len(q.jobs)
+}
+
+// drain stops accepting requests and waits until all queued payouts were
+// processed.
+func (q *payoutQueue) drain() {
+	q.mtx.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	n := len(q.jobs)
+	q.mtx.Unlock()
+
+	if n > 0 {
+		log.Infof("Waiting for %d queued payout(s) to be sent", n)
+	}
+	q.wg.Wait()
+}
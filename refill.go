@@ -0,0 +1,145 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"decred.org/dcrwallet/v3/rpc/client/dcrwallet"
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+// refillRecord is a transfer from the reserve account to walletaccount.
+// Amount is in atoms.
+type refillRecord struct {
+	Time   time.Time      `json:"time"`
+	Amount dcrutil.Amount `json:"amount"`
+	TxID   string         `json:"txid"`
+}
+
+// refillFeeReserve is the part of the reserve balance left for the fee of a
+// refill transfer.
+const refillFeeReserve = dcrutil.Amount(1e6)
+
+// refillMtx ensures only one refill runs at a time, since the balance update
+// triggered by a refill may start another one before the transfer is seen.
+var refillMtx sync.Mutex
+
+// refill tops up walletaccount of wallet w from the reserve account when its
+// available balance is below the low-water mark.  Nothing is moved in dry-run
+// mode.  At most the amount needed to reach the high-water mark is moved,
+// limited by the daily refill cap and the confirmed balance of the reserve.
+// Every transfer is recorded in the audit log.  Since available may be
+// outdated by the time the refill runs, the balance is read again before
+// acting on it.
+func refill(ctx context.Context, w *walletBackend, available dcrutil.Amount) {
+	if cfg.DryRun || available >= cfg.refillLow {
+		return
+	}
+	if !refillMtx.TryLock() {
+		return
+	}
+	defer refillMtx.Unlock()
+
+	// Another refill may have completed since available was read.
+	b, err := w.fetchBalance(ctx)
+	if err != nil {
+		log.Warnf("Unable to get the balance of wallet %s: %v", w, err)
+		return
+	}
+	if available = b.available(); available >= cfg.refillLow {
+		return
+	}
+
+	amount := cfg.refillHigh - available
+	if cfg.refillDailyCap > 0 {
+		refilled := state.refilledSince(time.Now().Add(-24 * time.Hour))
+		if remaining := cfg.refillDailyCap - refilled; remaining < amount {
+			amount = remaining
+		}
+	}
+	if amount <= 0 {
+		log.Warnf("Balance of %v is below the refill mark of %v, but the "+
+			"daily refill cap of %v is reached", available,
+			cfg.refillLow, cfg.refillDailyCap)
+		return
+	}
+
+	gbr, err := w.client.GetBalanceMinConf(ctx, cfg.ReserveAccount, 1)
+	if err != nil {
+		log.Warnf("Unable to get the balance of reserve account %q: %v",
+			cfg.ReserveAccount, err)
+		return
+	}
+	var reserve dcrutil.Amount
+	for _, b := range gbr.Balances {
+		if b.AccountName != cfg.ReserveAccount {
+			continue
+		}
+		spendable, err := dcrutil.NewAmount(b.Spendable)
+		if err == nil {
+			reserve += spendable
+		}
+	}
+	if reserve -= refillFeeReserve; reserve < amount {
+		amount = reserve
+	}
+	if amount <= 0 {
+		log.Warnf("Balance of %v is below the refill mark of %v, but "+
+			"reserve account %q is empty", available, cfg.refillLow,
+			cfg.ReserveAccount)
+		return
+	}
+
+	entry := &auditEntry{
+		Time:     time.Now(),
+		Decision: decisionRefilled,
+		Reserve:  cfg.ReserveAccount,
+	}
+	var granted dcrutil.Amount
+	var txid string
+	defer func() {
+		audit.record(entry, amount, granted, txid, err)
+	}()
+
+	addr, err := w.client.GetNewAddressGapPolicy(ctx, cfg.WalletAccount,
+		dcrwallet.GapPolicyWrap)
+	if err != nil {
+		log.Errorf("Unable to get a refill address: %v", err)
+		entry.Decision = decisionFailed
+		return
+	}
+	entry.Address = addr.String()
+
+	// Like every transaction funded by the faucet, the transfer is
+	// created with requestMtx held.
+	requestMtx.Lock()
+	hash, err := w.client.SendFromMinConf(ctx, cfg.ReserveAccount, addr,
+		amount, 1)
+	requestMtx.Unlock()
+	if err != nil {
+		log.Errorf("Failed to refill %v from reserve account %q: %v",
+			amount, cfg.ReserveAccount, err)
+		entry.Decision = decisionFailed
+		return
+	}
+	txid, granted = hash.String(), amount
+
+	log.Infof("Refilled %v from reserve account %q in %v (balance was %v)",
+		amount, cfg.ReserveAccount, txid, available)
+	err = state.addRefill(refillRecord{
+		Time:   time.Now(),
+		Amount: amount,
+		TxID:   txid,
+	})
+	if err != nil {
+		// The coins were moved, so only log the failure.
+		log.Errorf("Failed to record refill %v: %v", txid, err)
+		err = nil
+	}
+	requestBalanceUpdate()
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"decred.org/dcrwallet/v3/rpc/client/dcrwallet"
+)
+
+const (
+	// sessionCookieName is the name of the cookie identifying a browser
+	// session.
+	sessionCookieName = "faucetsession"
+
+	// sessionExpiry is how long a session, and the return address shown
+	// to it, is kept.  The issued address itself is kept in the state
+	// store for good.
+	sessionExpiry = 24 * time.Hour
+)
+
+// issuedAddress is a return address issued for a payout, so that later
+// returns to the address can be matched to the original requester.
+type issuedAddress struct {
+	Address       string    `json:"address"`
+	Issued        time.Time `json:"issued"`
+	PayoutTxID    string    `json:"payouttxid"`
+	PayoutAddress string    `json:"payoutaddress"`
+}
+
+// sessionAddress is the return address shown to a session.
+type sessionAddress struct {
+	address string
+	issued  time.Time
+}
+
+// returnAddressIssuer hands out a fresh wallet address to every session which
+// receives a payout.  The issued addresses are recorded in the state store,
+// while the sessions they are shown to are only kept in memory.
+type returnAddressIssuer struct {
+	c         *dcrwallet.Client
+	gapPolicy dcrwallet.GapPolicy
+
+	mtx       sync.Mutex
+	bySession map[string]sessionAddress
+}
+
+// newReturnAddressIssuer returns an issuer creating addresses in the faucet
+// account using the provided gap policy.
+func newReturnAddressIssuer(c *dcrwallet.Client, gapPolicy dcrwallet.GapPolicy) *returnAddressIssuer {
+	return &returnAddressIssuer{
+		c:         c,
+		gapPolicy: gapPolicy,
+		bySession: make(map[string]sessionAddress),
+	}
+}
+
+// prune forgets the sessions whose address was issued more than
+// sessionExpiry ago.  The caller must hold the mutex.
+func (i *returnAddressIssuer) prune(now time.Time) {
+	for s, issued := range i.bySession {
+		if now.Sub(issued.issued) >= sessionExpiry {
+			delete(i.bySession, s)
+		}
+	}
+}
+
+// addressFor returns the return address issued to session, if any.  Addresses
+// are only issued for payouts, so that viewing the page never derives a new
+// address.
+func (i *returnAddressIssuer) addressFor(session string) (string, bool) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	i.prune(time.Now())
+	issued, ok := i.bySession[session]
+	return issued.address, ok
+}
+
+// bindPayout issues a new return address to session and ties the payout txid
+// to payoutAddress to it.  Requests without a session are not bound.
+func (i *returnAddressIssuer) bindPayout(ctx context.Context, session, txid, payoutAddress string) {
+	if session == "" {
+		return
+	}
+
+	addr, err := i.c.GetNewAddressGapPolicy(ctx, cfg.WalletAccount, i.gapPolicy)
+	if err != nil {
+		log.Warnf("unable to issue return address for payout %v: %v",
+			txid, err)
+		return
+	}
+	issued := issuedAddress{
+		Address:       addr.String(),
+		Issued:        time.Now(),
+		PayoutTxID:    txid,
+		PayoutAddress: payoutAddress,
+	}
+	if prev, ok := state.returnAddress(issued.Address); ok {
+		// Addresses are reused once the gap limit wraps around.
+		log.Debugf("reissuing return address %v previously issued at %v",
+			issued.Address, prev.Issued)
+	}
+	if err := state.addReturnAddress(issued); err != nil {
+		log.Errorf("failed to record return address %v: %v",
+			issued.Address, err)
+	}
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	i.prune(issued.Issued)
+	i.bySession[session] = sessionAddress{issued.Address, issued.Issued}
+	log.Debugf("bound return address %v to payout %v", issued.Address, txid)
+}
+
+// sessionID returns the session identifier of the request.  A new session is
+// started and its cookie set on w when the request does not carry one.
+func sessionID(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(sessionCookieName); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Errorf("failed to create session id: %v", err)
+		return ""
+	}
+	id := hex.EncodeToString(b[:])
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(sessionExpiry.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+// requestSessionID returns the session identifier carried by the request, or
+// an empty string if there is none.
+func requestSessionID(r *http.Request) string {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"decred.org/dcrwallet/v3/rpc/client/dcrwallet"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/decred/dcrd/txscript/v4/stdaddr"
+	"github.com/decred/dcrd/txscript/v4/stdscript"
+	"github.com/decred/dcrd/wire"
+)
+
+// maxTopReturners is the number of entries shown on the returns leaderboard.
+const maxTopReturners = 10
+
+// coinReturn is a single payment received by the faucet return address.
+type coinReturn struct {
+	TxID   string
+	Amount dcrutil.Amount
+	Time   time.Time
+
+	// Sender is the address which funded the first input of the return
+	// transaction.  It is empty when it could not be determined.
+	Sender string
+
+	// Address is the return address which received the coins.
+	Address string
+
+	// Requester is the payout address of the request which was shown the
+	// rotated return address.  It is empty for returns to the static
+	// return address or when no payout was requested.
+	Requester string
+}
+
+// returner returns the address credited with the return.  Returns matched to
+// an earlier payout are credited to the original requester.
+func (r *coinReturn) returner() string {
+	if r.Requester != "" {
+		return r.Requester
+	}
+	return r.Sender
+}
+
+// returnerStat is an entry of the returns leaderboard.
+type returnerStat struct {
+	Address string
+	Amount  dcrutil.Amount
+	Count   int
+}
+
+// returnsTracker records coins sent back to the faucet return address and to
+// any rotated return addresses recorded in the state store.
+type returnsTracker struct {
+	c       *dcrwallet.Client
+	address string
+
+	mtx       sync.RWMutex
+	lastBlock *chainhash.Hash
+	seen      map[wire.OutPoint]struct{}
+	returns   []coinReturn
+}
+
+// newReturnsTracker returns a tracker for payments received by address and by
+// the rotated return addresses ever issued.
+func newReturnsTracker(c *dcrwallet.Client, address string) *returnsTracker {
+	return &returnsTracker{
+		c:       c,
+		address: address,
+		seen:    make(map[wire.OutPoint]struct{}),
+	}
+}
+
+// validateReturnAddress ensures the return address decodes on the active
+// network and belongs to the faucet account of the wallet.
+func validateReturnAddress(ctx context.Context, c *dcrwallet.Client, address string) error {
+	addr, err := stdaddr.DecodeAddress(address, activeNetParams.Params)
+	if err != nil {
+		return fmt.Errorf("walletaddress %v is invalid: %v", address, err)
+	}
+	res, err := c.ValidateAddress(ctx, addr)
+	if err != nil {
+		return fmt.Errorf("unable to validate walletaddress %v: %v",
+			address, err)
+	}
+	if !res.IsMine {
+		return fmt.Errorf("walletaddress %v does not belong to the wallet",
+			address)
+	}
+	if res.Account != cfg.WalletAccount {
+		return fmt.Errorf("walletaddress %v belongs to account %q, not %q",
+			address, res.Account, cfg.WalletAccount)
+	}
+	return nil
+}
+
+// refresh records all payments to the return addresses received since the last
+// refresh.
+func (t *returnsTracker) refresh(ctx context.Context) {
+	t.mtx.RLock()
+	lastBlock := t.lastBlock
+	t.mtx.RUnlock()
+
+	res, err := t.c.ListSinceBlock(ctx, lastBlock)
+	if err != nil {
+		log.Warnf("unable to list transactions for returns: %v", err)
+		return
+	}
+
+	var returns []coinReturn
+	for _, tx := range res.Transactions {
+		if tx.Category != "receive" {
+			continue
+		}
+		issued, rotated := state.returnAddress(tx.Address)
+		if tx.Address != t.address && !rotated {
+			continue
+		}
+		hash, err := chainhash.NewHashFromStr(tx.TxID)
+		if err != nil {
+			continue
+		}
+		op := wire.OutPoint{Hash: *hash, Index: tx.Vout}
+		t.mtx.RLock()
+		_, seen := t.seen[op]
+		t.mtx.RUnlock()
+		if seen {
+			continue
+		}
+		amount, err := dcrutil.NewAmount(tx.Amount)
+		if err != nil {
+			continue
+		}
+
+		r := coinReturn{
+			TxID:      tx.TxID,
+			Amount:    amount,
+			Time:      time.Unix(tx.TimeReceived, 0),
+			Sender:    t.sender(ctx, hash),
+			Address:   tx.Address,
+			Requester: issued.PayoutAddress,
+		}
+		log.Infof("received return of %v from %v to %v in %v", r.Amount,
+			r.returner(), r.Address, r.TxID)
+		t.mtx.Lock()
+		t.seen[op] = struct{}{}
+		t.mtx.Unlock()
+		returns = append(returns, r)
+	}
+
+	t.mtx.Lock()
+	t.returns = append(t.returns, returns...)
+	// Unmined transactions are listed again on the next refresh and are
+	// skipped since they were already seen.
+	if h, err := chainhash.NewHashFromStr(res.LastBlock); err == nil {
+		t.lastBlock = h
+	}
+	t.mtx.Unlock()
+}
+
+// sender returns the address which funded the first input of the transaction
+// with the provided hash, or an empty string if it can not be determined.  The
+// previous transaction is fetched with getrawtransaction, which dcrwallet
+// passes through to its dcrd connection.
+func (t *returnsTracker) sender(ctx context.Context, hash *chainhash.Hash) string {
+	tx, err := t.rawTransaction(ctx, hash)
+	if err != nil || len(tx.TxIn) == 0 {
+		log.Debugf("unable to fetch return transaction %v: %v", hash, err)
+		return ""
+	}
+	prevOut := tx.TxIn[0].PreviousOutPoint
+	prevTx, err := t.rawTransaction(ctx, &prevOut.Hash)
+	if err != nil || int(prevOut.Index) >= len(prevTx.TxOut) {
+		log.Debugf("unable to fetch previous transaction %v: %v",
+			prevOut.Hash, err)
+		return ""
+	}
+	out := prevTx.TxOut[prevOut.Index]
+	_, addrs := stdscript.ExtractAddrs(out.Version, out.PkScript,
+		activeNetParams.Params)
+	if len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0].String()
+}
+
+// rawTransaction fetches and deserializes the transaction with the provided
+// hash.
+func (t *returnsTracker) rawTransaction(ctx context.Context, hash *chainhash.Hash) (*wire.MsgTx, error) {
+	var txHex string
+	err := t.c.Call(ctx, "getrawtransaction", &txHex, hash.String(), 0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, err
+	}
+	tx := new(wire.MsgTx)
+	if err := tx.FromBytes(b); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// totals returns the amount returned within the last 24 hours and the amount
+// returned in total.
+func (t *returnsTracker) totals() (today, total dcrutil.Amount) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	now := time.Now()
+	for _, r := range t.returns {
+		total += r.Amount
+		if now.Sub(r.Time) < time.Hour*24 {
+			today += r.Amount
+		}
+	}
+	return today, total
+}
+
+// topReturners returns the addresses which returned the most coins, ordered by
+// descending amount.
+func (t *returnsTracker) topReturners() []returnerStat {
+	t.mtx.RLock()
+	stats := make(map[string]*returnerStat)
+	for i := range t.returns {
+		r := &t.returns[i]
+		returner := r.returner()
+		if returner == "" || returner == t.address {
+			continue
+		}
+		stat, ok := stats[returner]
+		if !ok {
+			stat = &returnerStat{Address: returner}
+			stats[returner] = stat
+		}
+		stat.Amount += r.Amount
+		stat.Count++
+	}
+	t.mtx.RUnlock()
+
+	top := make([]returnerStat, 0, len(stats))
+	for _, stat := range stats {
+		top = append(top, *stat)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Amount == top[j].Amount {
+			return top[i].Address < top[j].Address
+		}
+		return top[i].Amount > top[j].Amount
+	})
+	if len(top) > maxTopReturners {
+		top = top[:maxTopReturners]
+	}
+	return top
+}
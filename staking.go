@@ -0,0 +1,252 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/decred/dcrd/txscript/v4/stdaddr"
+)
+
+// stakingTierName is the tier recorded for staking payouts.  Cooldowns and
+// the daily limit of staking mode are tracked under this name.
+const stakingTierName = "staking"
+
+// Staking modes a requester can choose from.
+const (
+	// stakingTicket buys a ticket with voting rights assigned to the
+	// requested address.
+	stakingTicket = "ticket"
+
+	// stakingTicketPrice sends exactly the current ticket price to the
+	// requested address.
+	stakingTicketPrice = "ticketprice"
+)
+
+// newStakingTier returns the pseudo tier holding the limits of staking mode.
+// Its amount is the maximum ticket price.
+func newStakingTier(cfg *config) *payoutTier {
+	return &payoutTier{
+		Name:     stakingTierName,
+		Amount:   cfg.stakingMaxPrice,
+		Cooldown: cfg.StakingCooldown,
+	}
+}
+
+// ticketPrice returns the current ticket price as reported by wallet w.
+func ticketPrice(ctx context.Context, w *walletBackend) (dcrutil.Amount, error) {
+	info, err := w.client.GetStakeInfo(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return dcrutil.NewAmount(info.Difficulty)
+}
+
+// prepareStake checks a request in staking mode.  Staking requests have their
+// own cooldown and daily limit and are always served by the primary wallet,
+// since tickets are bought from walletaccount.  Requests with an API key are
+// limited by the key instead of the cooldown.  The amount of p is set to the
+// current ticket price.
+func prepareStake(ctx context.Context, req *payRequest, entry *auditEntry, p *payout) error {
+	tier := cfg.stakingTier
+	if tier == nil {
+		return newFaucetError(errCodeStakingDisabled)
+	}
+	p.tier = tier
+	entry.Tier = tier.Name
+	switch req.staking {
+	case stakingTicket, stakingTicketPrice:
+	default:
+		return newFaucetError(errCodeUnknownStakingMode, req.staking)
+	}
+
+	client := clientID(tier, req.hostIP, req.subject)
+	switch {
+	case p.key != nil:
+		// The limits of the key are checked once the price is known.
+	case req.overrideToken == cfg.OverrideToken:
+		entry.Token = tokenOverride
+	default:
+		last, ok := state.lastRequest(tier.Name, client)
+		if coolDownTime := time.Until(last.Add(tier.Cooldown)); ok && coolDownTime >= 0 {
+			log.Debugf("client exceeded staking rate limit (ip: %s, "+
+				"address: %s)", req.hostIP, req.address)
+			return newFaucetError(errCodeRateLimited,
+				tier.Amount, int64(tier.Cooldown.Seconds()),
+				tier.Name, int(coolDownTime.Seconds()))
+		}
+	}
+
+	n, _ := state.tierUsageSince(time.Now().Add(-24*time.Hour), tier.Name)
+	if n >= cfg.StakingDailyLimit {
+		return newFaucetError(errCodeStakingLimit, cfg.StakingDailyLimit)
+	}
+
+	address, err := stdaddr.DecodeAddress(req.address, activeNetParams.Params)
+	if err != nil {
+		log.Errorf("ip %v submitted bad address %v: %v", req.hostIP,
+			req.address, err)
+		return newFaucetError(errCodeInvalidAddress, req.address)
+	}
+	if !req.addressChecked {
+		if err := checkAddressPolicy(ctx, address, true); err != nil {
+			log.Debugf("ip %v submitted refused staking address "+
+				"%v: %v", req.hostIP, req.address, err)
+			return err
+		}
+		req.addressChecked = true
+	}
+	p.address = address
+
+	w := wallets.backends[0]
+	if !w.isHealthy() {
+		return errNoWallet
+	}
+	p.wallet = w
+	price, err := ticketPrice(ctx, w)
+	if err != nil {
+		entry.Decision = decisionFailed
+		return newFaucetError(errCodePayoutFailed, err)
+	}
+	p.amount = price
+	if price > tier.Amount {
+		return newFaucetError(errCodeTicketPriceTooHigh, price, tier.Amount)
+	}
+
+	// The transaction limit applies to tickets like to any other payout.
+	amountMtx.RLock()
+	tLimit := transactionLimit
+	amountMtx.RUnlock()
+	if price > tLimit {
+		return newFaucetError(errCodeAmountExceedsLimit)
+	}
+	if p.key != nil {
+		if err := checkAPIKeyLimits(p.key, price); err != nil {
+			log.Debugf("API key %s exceeded its limits: %v", p.key.ID,
+				err)
+			return err
+		}
+	}
+	return nil
+}
+
+// stake processes a request in staking mode prepared by prepareStake, either
+// buying a ticket voting with the requested address or funding it with the
+// current ticket price.  It returns the ticket hash or txid.  It must be
+// called with requestMtx held.  In dry-run mode both modes are simulated by a
+// signed but unpublished transfer of the ticket price.
+func stake(ctx context.Context, req *payRequest, entry *auditEntry, p *payout) (string, error) {
+	tier, address, w, price := p.tier, p.address, p.wallet, p.amount
+
+	err := w.applyFeeRate(ctx)
+	if err != nil {
+		entry.Decision = decisionFailed
+		return "", newFaucetError(errCodePayoutFailed, err)
+	}
+
+	var txid string
+	var hash *chainhash.Hash
+	var fee dcrutil.Amount
+	switch {
+	case cfg.DryRun:
+		// A ticket purchase cannot be built without publishing it, so
+		// both modes are simulated by a transfer of the ticket price.
+		hash, fee, err = w.simulate(ctx, []payment{{address, price}}, 0,
+			nil)
+		if err != nil {
+			log.Errorf("error simulating staking request %v for %v: %v",
+				req.staking, req.hostIP, err)
+			entry.Decision = decisionFailed
+			if isInsufficientFundsError(err) {
+				return "", insufficientFundsError(price, 0)
+			}
+			return "", newFaucetError(errCodePayoutFailed, err)
+		}
+		txid = hash.String()
+		entry.Simulated = true
+		log.Infof("simulated staking request %v of %v to %v for %v",
+			req.staking, price, address, req.hostIP)
+
+	case req.staking == stakingTicket:
+		// Tickets may be bought with unconfirmed funds, like any
+		// other payout.
+		minConf, numTickets := 0, 1
+		tickets, err := w.client.PurchaseTicket(ctx, w.endpoint.Account,
+			tier.Amount, &minConf, address, &numTickets, nil, nil, nil,
+			nil, nil)
+		if err == nil && len(tickets) == 0 {
+			err = errors.New("wallet purchased no ticket")
+		}
+		if err != nil {
+			log.Errorf("error purchasing ticket voting with %v for %v: %v",
+				address, req.hostIP, err)
+			entry.Decision = decisionFailed
+			if isInsufficientFundsError(err) {
+				return "", insufficientFundsError(price, 0)
+			}
+			return "", newFaucetError(errCodePayoutFailed, err)
+		}
+		hash = tickets[0]
+		txid = hash.String()
+		log.Infof("successfully purchased ticket %v voting with %v for %v",
+			txid, address, req.hostIP)
+
+	case req.staking == stakingTicketPrice:
+		hash, err = w.client.SendFromMinConf(ctx, w.endpoint.Account,
+			address, price, 0)
+		if err != nil {
+			log.Errorf("error sending ticket price %v to %v for %v: %v",
+				price, address, req.hostIP, err)
+			entry.Decision = decisionFailed
+			if isInsufficientFundsError(err) {
+				return "", insufficientFundsError(price, 0)
+			}
+			return "", newFaucetError(errCodePayoutFailed, err)
+		}
+		txid = hash.String()
+		log.Infof("successfully sent ticket price %v to %v for %v",
+			price, address, req.hostIP)
+	}
+
+	if !cfg.DryRun {
+		fee = w.transactionFee(ctx, hash)
+		recordFee(fee)
+	}
+	err = state.addPayout(payoutRecord{
+		TxID:    txid,
+		Time:    time.Now(),
+		IP:      req.hostIP,
+		Address: req.address,
+		Amount:  price,
+		Tier:    tier.Name,
+		Token:   entry.Token,
+		Subject: req.subject,
+		APIKey:  req.apiKey,
+		Staking: req.staking,
+		Wallet:  w.String(),
+		Fee:     fee,
+
+		IdempotencyKey: req.idempotencyKey,
+		RequestID:      req.requestID,
+		Purpose:        req.purpose,
+		Simulated:      cfg.DryRun,
+	})
+	if err != nil {
+		// The coins were spent, so only log the failure.
+		log.Errorf("failed to record staking payout %v: %v", txid, err)
+	}
+	if p.key != nil && !cfg.DryRun {
+		apiKeys.recordUsage(p.key.ID, price)
+	}
+	history.addPayout(time.Now(), price)
+	publishPayout(txid, price, req.address, tier.Name)
+	updateBalance()
+
+	return txid, nil
+}
@@ -0,0 +1,544 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+const (
+	// stateFilename is the name of the file in the data directory which
+	// holds the mutable faucet state.
+	stateFilename = "state.json"
+
+	// payoutsFilename is the name of the append-only file in the data
+	// directory which holds the payout history as JSON lines.
+	payoutsFilename = "payouts.jsonl"
+)
+
+// payoutRecord is a single payout of the faucet.  Amount is in atoms.
+type payoutRecord struct {
+	TxID    string         `json:"txid"`
+	Time    time.Time      `json:"time"`
+	IP      string         `json:"ip"`
+	Address string         `json:"address"`
+	Amount  dcrutil.Amount `json:"amount"`
+	Tier    string         `json:"tier,omitempty"`
+	Token   string         `json:"token,omitempty"`
+
+	// Subject identifies the logged in user who requested the payout.
+	Subject string `json:"subject,omitempty"`
+
+	// IdempotencyKey is the client provided key identifying the request
+	// which caused the payout.
+	IdempotencyKey string `json:"idempotencykey,omitempty"`
+
+	// APIKey is the ID of the API key which authenticated the request.
+	APIKey string `json:"apikey,omitempty"`
+
+	// Wallet is the host of the wallet which sent the payout.
+	Wallet string `json:"wallet,omitempty"`
+
+	// Fee is the transaction fee paid for the payout in atoms.
+	Fee dcrutil.Amount `json:"fee,omitempty"`
+
+	// RequestID is the faucet generated ID of the request which caused the
+	// payout.
+	RequestID string `json:"requestid,omitempty"`
+
+	// Purpose is the purpose of the payout given by the requester.
+	Purpose string `json:"purpose,omitempty"`
+
+	// Staking is the staking mode of the request, if any.  TxID is the
+	// ticket hash of purchased tickets.
+	Staking string `json:"staking,omitempty"`
+
+	// Simulated is set for payouts of dry-run mode, which were signed but
+	// never broadcast.  TxID is the hash the transaction would have had.
+	Simulated bool `json:"simulated,omitempty"`
+}
+
+// payoutFilter selects payouts from the history.  Zero values match all
+// payouts.
+type payoutFilter struct {
+	IP      string
+	Address string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// match returns whether p is selected by the filter, ignoring the limit.
+func (f *payoutFilter) match(p *payoutRecord) bool {
+	switch {
+	case f.IP != "" && p.IP != f.IP:
+		return false
+	case f.Address != "" && p.Address != f.Address:
+		return false
+	case !f.Since.IsZero() && p.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !p.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// persistentState is the mutable faucet state which is rewritten on every
+// change.
+type persistentState struct {
+	// Cooldowns maps payout tier and client IP pairs, as created by
+	// cooldownKey, to the time of the last payout of the client in the
+	// tier.
+	Cooldowns map[string]time.Time `json:"cooldowns"`
+
+	// Blocked maps blocked payout addresses to the time they were blocked.
+	Blocked map[string]time.Time `json:"blocked"`
+
+	// Paused is set when payouts are suspended by an operator.
+	Paused bool `json:"paused"`
+
+	// Refills are the transfers from the reserve account within the last
+	// day, used to enforce the daily refill cap.
+	Refills []refillRecord `json:"refills,omitempty"`
+
+	// ReturnAddresses maps the rotated return addresses issued for payouts
+	// to their issue record.  They are kept for good, since coins may be
+	// returned to them at any time.
+	ReturnAddresses map[string]issuedAddress `json:"returnaddresses,omitempty"`
+}
+
+// stateStore holds the faucet state and payout history and persists them in
+// the data directory.
+type stateStore struct {
+	dir string
+
+	mtx         sync.RWMutex
+	state       persistentState
+	payouts     []payoutRecord
+	payoutsFile *os.File
+
+	// byIdempotencyKey maps idempotency keys, as scoped by
+	// idempotencyScope, to the index of their payout.
+	byIdempotencyKey map[string]int
+}
+
+// state is the persisted faucet state.  It is opened in main.
+var state *stateStore
+
+// openStateStore loads the faucet state and payout history from dir, creating
+// the directory and files as needed.
+func openStateStore(dir string) (*stateStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &stateStore{
+		dir: dir,
+		state: persistentState{
+			Cooldowns: make(map[string]time.Time),
+			Blocked:   make(map[string]time.Time),
+		},
+		byIdempotencyKey: make(map[string]int),
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, stateFilename))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, &s.state); err != nil {
+			return nil, fmt.Errorf("%s: %v", stateFilename, err)
+		}
+		if s.state.Cooldowns == nil {
+			s.state.Cooldowns = make(map[string]time.Time)
+		}
+		if s.state.Blocked == nil {
+			s.state.Blocked = make(map[string]time.Time)
+		}
+	}
+	if s.state.ReturnAddresses == nil {
+		s.state.ReturnAddresses = make(map[string]issuedAddress)
+	}
+
+	payoutsPath := filepath.Join(dir, payoutsFilename)
+	f, err := os.OpenFile(payoutsPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var p payoutRecord
+		if err := json.Unmarshal(scanner.Bytes(), &p); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s:%d: %v", payoutsFilename, line, err)
+		}
+		if p.IdempotencyKey != "" {
+			s.byIdempotencyKey[p.idempotencyScope()] = len(s.payouts)
+		}
+		s.payouts = append(s.payouts, p)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.payoutsFile = f
+
+	return s, nil
+}
+
+// close closes the payout history file.
+func (s *stateStore) close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.payoutsFile.Close()
+}
+
+// save writes the mutable state to disk.  Cooldowns which have expired or
+// belong to tiers which no longer exist are dropped, as are refills older than
+// a day.  It must be called with the mutex held for writes.
+func (s *stateStore) save() error {
+	now := time.Now()
+	for key, t := range s.state.Cooldowns {
+		name, _, _ := strings.Cut(key, "/")
+		tier, ok := cooldownTier(name)
+		if !ok || now.Sub(t) >= tier.Cooldown {
+			delete(s.state.Cooldowns, key)
+		}
+	}
+	refills := s.state.Refills[:0]
+	for _, r := range s.state.Refills {
+		if now.Sub(r.Time) < 24*time.Hour {
+			refills = append(refills, r)
+		}
+	}
+	s.state.Refills = refills
+
+	b, err := json.MarshalIndent(&s.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash never leaves a
+	// truncated state file behind.
+	path := filepath.Join(s.dir, stateFilename)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// addPayout appends p to the payout history and starts the cooldown of the
+// requesting client in the payout tier.  Payouts to API keys are limited by
+// the key instead and start no cooldown.
+func (s *stateStore) addPayout(p payoutRecord) error {
+	b, err := json.Marshal(&p)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if p.IdempotencyKey != "" {
+		s.byIdempotencyKey[p.idempotencyScope()] = len(s.payouts)
+	}
+	s.payouts = append(s.payouts, p)
+	if p.APIKey == "" {
+		tier, _ := cooldownTier(p.Tier)
+		client := clientID(tier, p.IP, p.Subject)
+		s.state.Cooldowns[cooldownKey(p.Tier, client)] = p.Time
+	}
+	if _, err := s.payoutsFile.Write(b); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// idempotencyScope returns the idempotency key of a request scoped to the
+// client which made it, identified by its API key, its logged in user or its
+// IP in this order.  Clients thus never see the payouts of another client
+// which happened to use the same key.
+func idempotencyScope(key, ip, subject, apiKey string) string {
+	switch {
+	case apiKey != "":
+		return "key:" + apiKey + "/" + key
+	case subject != "":
+		return "sub:" + subject + "/" + key
+	}
+	return ip + "/" + key
+}
+
+// idempotencyScope returns the scoped idempotency key of the payout.
+func (p *payoutRecord) idempotencyScope() string {
+	return idempotencyScope(p.IdempotencyKey, p.IP, p.Subject, p.APIKey)
+}
+
+// payoutByIdempotencyKey returns the payout made for the request identified by
+// the idempotency key, as scoped by idempotencyScope.
+func (s *stateStore) payoutByIdempotencyKey(key string) (payoutRecord, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	i, ok := s.byIdempotencyKey[key]
+	if !ok {
+		return payoutRecord{}, false
+	}
+	return s.payouts[i], true
+}
+
+// payoutsByIdempotencyKey returns all payouts made for the request identified
+// by the idempotency key, as scoped by idempotencyScope, such as the payouts of
+// a bulk request.
+func (s *stateStore) payoutsByIdempotencyKey(key string) []payoutRecord {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	i, ok := s.byIdempotencyKey[key]
+	if !ok {
+		return nil
+	}
+	// The payouts of a request are recorded one after another, and the
+	// index of the key is the one of the last payout.
+	id := s.payouts[i].RequestID
+	first := i
+	for id != "" && first > 0 && s.payouts[first-1].RequestID == id {
+		first--
+	}
+	return append([]payoutRecord(nil), s.payouts[first:i+1]...)
+}
+
+// lastRequest returns the time of the last payout to a client, as returned by
+// clientID, in tier, if it may still be cooling down.
+func (s *stateStore) lastRequest(tier, client string) (time.Time, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	t, ok := s.state.Cooldowns[cooldownKey(tier, client)]
+	return t, ok
+}
+
+// clearCooldown removes the cooldowns of client, as returned by clientID, in
+// all tiers, or of all clients when client is empty.  It returns the number of
+// cooldowns removed.
+func (s *stateStore) clearCooldown(client string) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var n int
+	if client == "" {
+		n = len(s.state.Cooldowns)
+		s.state.Cooldowns = make(map[string]time.Time)
+	} else {
+		for key := range s.state.Cooldowns {
+			if strings.HasSuffix(key, "/"+client) {
+				delete(s.state.Cooldowns, key)
+				n++
+			}
+		}
+	}
+	return n, s.save()
+}
+
+// addReturnAddress records a rotated return address issued for a payout.  A
+// reissued address replaces its earlier record.
+func (s *stateStore) addReturnAddress(a issuedAddress) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.state.ReturnAddresses[a.Address] = a
+	return s.save()
+}
+
+// returnAddress returns the issue record of the rotated return address.
+func (s *stateStore) returnAddress(address string) (issuedAddress, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	a, ok := s.state.ReturnAddresses[address]
+	return a, ok
+}
+
+// setBlocked blocks or unblocks payouts to address.
+func (s *stateStore) setBlocked(address string, blocked bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if blocked {
+		s.state.Blocked[address] = time.Now()
+	} else {
+		delete(s.state.Blocked, address)
+	}
+	return s.save()
+}
+
+// isBlocked returns whether payouts to address are blocked.
+func (s *stateStore) isBlocked(address string) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	_, ok := s.state.Blocked[address]
+	return ok
+}
+
+// blocked returns all blocked addresses in sorted order.
+func (s *stateStore) blocked() []string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	addrs := make([]string, 0, len(s.state.Blocked))
+	for addr := range s.state.Blocked {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// setPaused suspends or resumes payouts.
+func (s *stateStore) setPaused(paused bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.state.Paused = paused
+	return s.save()
+}
+
+// isPaused returns whether payouts are suspended.
+func (s *stateStore) isPaused() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	return s.state.Paused
+}
+
+// queryPayouts returns the payouts selected by f, most recent first.
+func (s *stateStore) queryPayouts(f *payoutFilter) []payoutRecord {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	var payouts []payoutRecord
+	for i := len(s.payouts) - 1; i >= 0; i-- {
+		if f.Limit > 0 && len(payouts) >= f.Limit {
+			break
+		}
+		if f.match(&s.payouts[i]) {
+			payouts = append(payouts, s.payouts[i])
+		}
+	}
+	return payouts
+}
+
+// sentSince returns the total amount paid out in tier since t.  An empty tier
+// includes payouts of all tiers.
+func (s *stateStore) sentSince(t time.Time, tier string) dcrutil.Amount {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	var total dcrutil.Amount
+	for i := len(s.payouts) - 1; i >= 0; i-- {
+		if s.payouts[i].Time.Before(t) {
+			break
+		}
+		if tier == "" || s.payouts[i].Tier == tier {
+			total += s.payouts[i].Amount
+		}
+	}
+	return total
+}
+
+// keyUsageSince returns the number and total amount of payouts made to the API
+// key with the provided ID since t.
+func (s *stateStore) keyUsageSince(t time.Time, id string) (int, dcrutil.Amount) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	var n int
+	var total dcrutil.Amount
+	for i := len(s.payouts) - 1; i >= 0; i-- {
+		if s.payouts[i].Time.Before(t) {
+			break
+		}
+		if s.payouts[i].APIKey == id {
+			n++
+			total += s.payouts[i].Amount
+		}
+	}
+	return n, total
+}
+
+// addRefill records a transfer from the reserve account.
+func (s *stateStore) addRefill(r refillRecord) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.state.Refills = append(s.state.Refills, r)
+	return s.save()
+}
+
+// refilledSince returns the total amount moved from the reserve account since
+// t.
+func (s *stateStore) refilledSince(t time.Time) dcrutil.Amount {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	var total dcrutil.Amount
+	for _, r := range s.state.Refills {
+		if !r.Time.Before(t) {
+			total += r.Amount
+		}
+	}
+	return total
+}
+
+// tierUsageSince returns the number and total amount of payouts made in tier
+// since t.
+func (s *stateStore) tierUsageSince(t time.Time, tier string) (int, dcrutil.Amount) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	var n int
+	var total dcrutil.Amount
+	for i := len(s.payouts) - 1; i >= 0; i-- {
+		if s.payouts[i].Time.Before(t) {
+			break
+		}
+		if s.payouts[i].Tier == tier {
+			n++
+			total += s.payouts[i].Amount
+		}
+	}
+	return n, total
+}
+
+// feesSince returns the total transaction fee paid for payouts since t.
+func (s *stateStore) feesSince(t time.Time) dcrutil.Amount {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	var total dcrutil.Amount
+	for i := len(s.payouts) - 1; i >= 0; i-- {
+		if s.payouts[i].Time.Before(t) {
+			break
+		}
+		total += s.payouts[i].Fee
+	}
+	return total
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/decred/dcrd/dcrutil/v4"
+)
+
+// defaultTierName is the name of the tier created from withdrawalamount and
+// withdrawaltimelimit when no payout tiers are configured.
+const defaultTierName = "default"
+
+// payoutTier is an operator defined payout option.  Requesters choose a tier
+// and each tier has its own maximum amount, cooldown per client and daily
+// budget.
+type payoutTier struct {
+	Name     string
+	Amount   dcrutil.Amount
+	Cooldown time.Duration
+
+	// Budget is the maximum amount paid out in this tier within 24 hours.
+	// Zero means unlimited.
+	Budget dcrutil.Amount
+
+	// LoginRequired is set for tiers only available to logged in users.
+	LoginRequired bool
+}
+
+// String returns a human readable description of the tier.
+func (t *payoutTier) String() string {
+	return fmt.Sprintf("%v every %v", t.Amount, t.Cooldown)
+}
+
+// parsePayoutTier parses a tier specified as
+// "name:amount:cooldown[:dailybudget]" where the amounts are in DCR and the
+// cooldown is a duration such as 30s or 1h.
+func parsePayoutTier(s string) (*payoutTier, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 3 && len(fields) != 4 {
+		return nil, fmt.Errorf("payout tier %q is not in the form "+
+			"name:amount:cooldown[:dailybudget]", s)
+	}
+
+	t := &payoutTier{Name: strings.TrimSpace(fields[0])}
+	if t.Name == "" || strings.ContainsAny(t.Name, "/ ") {
+		return nil, fmt.Errorf("payout tier %q: invalid name", s)
+	}
+
+	amount, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("payout tier %q: %v", s, err)
+	}
+	t.Amount, err = dcrutil.NewAmount(amount)
+	if err != nil || t.Amount <= 0 {
+		return nil, fmt.Errorf("payout tier %q: invalid amount %q", s,
+			fields[1])
+	}
+
+	t.Cooldown, err = time.ParseDuration(fields[2])
+	if err != nil || t.Cooldown <= 0 {
+		return nil, fmt.Errorf("payout tier %q: invalid cooldown %q", s,
+			fields[2])
+	}
+
+	if len(fields) == 4 {
+		budget, err := strconv.ParseFloat(fields[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("payout tier %q: %v", s, err)
+		}
+		t.Budget, err = dcrutil.NewAmount(budget)
+		if err != nil || t.Budget < 0 {
+			return nil, fmt.Errorf("payout tier %q: invalid budget %q",
+				s, fields[3])
+		}
+	}
+
+	return t, nil
+}
+
+// newPayoutTiers creates the payout tiers described by the configuration,
+// sorted by ascending amount.  A single default tier is created from the
+// withdrawal amount and time limit when no tiers are configured.
+func newPayoutTiers(cfg *config) ([]*payoutTier, error) {
+	if len(cfg.PayoutTiers) == 0 {
+		return []*payoutTier{{
+			Name:     defaultTierName,
+			Amount:   cfg.withdrawalAmount,
+			Cooldown: cfg.withdrawalTimeLimit,
+		}}, nil
+	}
+
+	tiers := make([]*payoutTier, 0, len(cfg.PayoutTiers))
+	names := make(map[string]struct{}, len(cfg.PayoutTiers))
+	for _, s := range cfg.PayoutTiers {
+		t, err := parsePayoutTier(s)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := names[t.Name]; ok {
+			return nil, fmt.Errorf("duplicate payout tier %q", t.Name)
+		}
+		names[t.Name] = struct{}{}
+		tiers = append(tiers, t)
+	}
+	sort.SliceStable(tiers, func(i, j int) bool {
+		return tiers[i].Amount < tiers[j].Amount
+	})
+	return tiers, nil
+}
+
+// tierByName returns the configured tier with the provided name.
+func tierByName(name string) (*payoutTier, bool) {
+	for _, t := range cfg.payoutTiers {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// cooldownTier returns the tier a cooldown is tracked under, which is either
+// a configured tier or the staking tier.
+func cooldownTier(name string) (*payoutTier, bool) {
+	if cfg.stakingTier != nil && name == cfg.stakingTier.Name {
+		return cfg.stakingTier, true
+	}
+	return tierByName(name)
+}
+
+// availableTiers returns the tiers available to anonymous or logged in users,
+// sorted by ascending amount.
+func availableTiers(loggedIn bool) []*payoutTier {
+	tiers := make([]*payoutTier, 0, len(cfg.payoutTiers))
+	for _, t := range cfg.payoutTiers {
+		if !t.LoginRequired || loggedIn {
+			tiers = append(tiers, t)
+		}
+	}
+	return tiers
+}
+
+// selectTier returns the tier for a request.  A named tier must exist and be
+// available to the user.  Without a name, the smallest available tier allowing
+// the requested amount is chosen, or the smallest tier when no amount was
+// requested.  Tiers requiring login are preferred for logged in users.
+func selectTier(name string, amount dcrutil.Amount, loggedIn bool) (*payoutTier, error) {
+	if name != "" {
+		t, ok := tierByName(name)
+		if !ok {
+			return nil, newFaucetError(errCodeUnknownTier, name)
+		}
+		if t.LoginRequired && !loggedIn {
+			return nil, newFaucetError(errCodeLoginRequired)
+		}
+		return t, nil
+	}
+
+	tiers := availableTiers(loggedIn)
+	if len(tiers) == 0 {
+		return nil, newFaucetError(errCodeLoginRequired)
+	}
+	for _, loginTiers := range []bool{loggedIn, false} {
+		for _, t := range tiers {
+			if t.LoginRequired == loginTiers && amount <= t.Amount {
+				return t, nil
+			}
+		}
+	}
+	largest := tiers[len(tiers)-1]
+	return nil, newFaucetError(errCodeAmountExceedsTiers, largest.Name,
+		largest.Amount)
+}
+
+// clientID returns the identifier cooldowns of a client in tier apply to,
+// which is the subject of logged in users in tiers requiring a login and the IP
+// otherwise.  Keying anonymous tiers by IP keeps a user from claiming them
+// once per login in addition to once per IP.
+func clientID(tier *payoutTier, ip, subject string) string {
+	if tier != nil && tier.LoginRequired && subject != "" {
+		return subjectClientID(subject)
+	}
+	return ip
+}
+
+// subjectClientID returns the identifier of the logged in user subject used by
+// clientID.
+func subjectClientID(subject string) string {
+	return "sub:" + subject
+}
+
+// cooldownKey returns the key of the cooldown of a client, as returned by
+// clientID, in tier.  Cooldowns are intentionally kept per tier rather than
+// per client, so that a client waiting for a large payout may still request
+// small ones.  The total paid out is bounded by the tier budgets instead.
+func cooldownKey(tier, client string) string {
+	return tier + "/" + client
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"decred.org/dcrwallet/v3/rpc/client/dcrwallet"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/decred/dcrd/txscript/v4/stdaddr"
+)
+
+const (
+	// utxoPoolCheckInterval is how often the UTXO pool is checked.
+	utxoPoolCheckInterval = time.Minute
+
+	// maxSplitOutputs is the maximum number of outputs created by a single
+	// fan-out transaction.
+	maxSplitOutputs = 100
+
+	// splitFeeReserve is the amount kept aside to pay the fee of a fan-out
+	// transaction.
+	splitFeeReserve = dcrutil.Amount(1e6)
+)
+
+// utxoPool keeps the faucet account split into a target number of confirmed
+// outputs of a fixed size, so that consecutive payouts can each spend their
+// own confirmed output instead of chaining on unconfirmed change.
+type utxoPool struct {
+	c      *dcrwallet.Client
+	size   int
+	amount dcrutil.Amount
+
+	// pendingSplit is the hash of the last fan-out transaction while it is
+	// still unconfirmed.  No new split is started until it confirms.
+	pendingSplit *chainhash.Hash
+}
+
+// newUTXOPool returns a UTXO pool which maintains size outputs of amount.
+func newUTXOPool(c *dcrwallet.Client, size int, amount dcrutil.Amount) *utxoPool {
+	return &utxoPool{
+		c:      c,
+		size:   size,
+		amount: amount,
+	}
+}
+
+// run checks the pool every utxoPoolCheckInterval until quit is closed.
+func (p *utxoPool) run(quit <-chan struct{}) {
+	poolLog.Infof("Maintaining %d outputs of %v in account %q", p.size,
+		p.amount, cfg.WalletAccount)
+
+	ticker := time.NewTicker(utxoPoolCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		p.check(context.Background())
+
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// outputs returns the number of confirmed and spendable outputs of the faucet
+// account which are large enough to fund a payout on their own, as well as the
+// total confirmed spendable amount.
+func (p *utxoPool) outputs(ctx context.Context) (int, dcrutil.Amount, error) {
+	unspent, err := p.c.ListUnspentMin(ctx, 1)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var n int
+	var total dcrutil.Amount
+	for _, u := range unspent {
+		if u.Account != cfg.WalletAccount || !u.Spendable {
+			continue
+		}
+		amount, err := dcrutil.NewAmount(u.Amount)
+		if err != nil {
+			continue
+		}
+		total += amount
+		if amount >= p.amount {
+			n++
+		}
+	}
+	return n, total, nil
+}
+
+// check refills the pool with a fan-out transaction when fewer than half of
+// the target number of outputs are available.
+func (p *utxoPool) check(ctx context.Context) {
+	if p.pendingSplit != nil {
+		tx, err := p.c.GetTransaction(ctx, p.pendingSplit)
+		if err != nil {
+			poolLog.Warnf("Unable to look up split transaction %v: %v",
+				p.pendingSplit, err)
+			return
+		}
+		if tx.Confirmations < 1 {
+			poolLog.Debugf("Waiting for split transaction %v to confirm",
+				p.pendingSplit)
+			return
+		}
+		poolLog.Infof("Split transaction %v confirmed", p.pendingSplit)
+		p.pendingSplit = nil
+	}
+
+	n, total, err := p.outputs(ctx)
+	if err != nil {
+		poolLog.Warnf("Unable to list unspent outputs: %v", err)
+		return
+	}
+	metricUTXOPoolOutputs.Set(int64(n))
+	poolLog.Debugf("UTXO pool has %d of %d outputs", n, p.size)
+	if n >= p.size/2 {
+		return
+	}
+
+	want := p.size - n
+	if want > maxSplitOutputs {
+		want = maxSplitOutputs
+	}
+	if affordable := int((total - splitFeeReserve) / p.amount); want > affordable {
+		want = affordable
+	}
+	if want < 2 {
+		poolLog.Warnf("UTXO pool is low (%d of %d outputs) but confirmed "+
+			"funds of %v are insufficient to refill it", n, p.size, total)
+		return
+	}
+
+	if err := p.split(ctx, want); err != nil {
+		metricUTXOPoolSplitErrors.Add(1)
+		poolLog.Errorf("Unable to split %d outputs of %v: %v", want,
+			p.amount, err)
+	}
+}
+
+// split creates a fan-out transaction paying n outputs of the pool amount to
+// fresh internal addresses of the faucet account.  It holds requestMtx so that
+// the split never competes with a payout for the same outputs.
+func (p *utxoPool) split(ctx context.Context, n int) error {
+	if cfg.DryRun {
+		poolLog.Infof("Dry-run mode: not splitting %d outputs of %v", n,
+			p.amount)
+		return nil
+	}
+
+	requestMtx.Lock()
+	defer requestMtx.Unlock()
+
+	amounts := make(map[stdaddr.Address]dcrutil.Amount, n)
+	for len(amounts) < n {
+		addr, err := p.c.GetRawChangeAddress(ctx, cfg.WalletAccount,
+			activeNetParams.Params)
+		if err != nil {
+			return err
+		}
+		amounts[addr] = p.amount
+	}
+
+	hash, err := p.c.SendManyMinConf(ctx, cfg.WalletAccount, amounts, 1)
+	if err != nil {
+		return err
+	}
+
+	p.pendingSplit = hash
+	metricUTXOPoolSplits.Add(1)
+	metricUTXOPoolSplitOutputs.Add(int64(n))
+	poolLog.Infof("Sent split transaction %v creating %d outputs of %v",
+		hash, n, p.amount)
+	requestBalanceUpdate()
+	return nil
+}
@@ -0,0 +1,518 @@
+// Copyright (c) 2023 The Decred developers
+// Use of this source code is governed by an ISC
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"decred.org/dcrwallet/v3/rpc/client/dcrwallet"
+	"decred.org/dcrwallet/v3/rpc/jsonrpc/types"
+	"github.com/decred/dcrd/chaincfg/chainhash"
+	"github.com/decred/dcrd/chaincfg/v3"
+	"github.com/decred/dcrd/dcrjson/v4"
+	"github.com/decred/dcrd/dcrutil/v4"
+	"github.com/decred/dcrd/rpcclient/v8"
+	"github.com/decred/dcrd/txscript/v4"
+	"github.com/decred/dcrd/txscript/v4/stdaddr"
+	"github.com/decred/dcrd/wire"
+)
+
+// walletHealthInterval is how often the health of every wallet is checked.
+const walletHealthInterval = 30 * time.Second
+
+// errNoWallet is returned when no healthy wallet is available to send a
+// payout.
+var errNoWallet = newFaucetError(errCodeWalletUnavailable)
+
+// walletEndpoint describes a dcrwallet RPC server payouts can be sent from.
+type walletEndpoint struct {
+	Host     string
+	User     string
+	Password string
+	Cert     string
+	Account  string
+}
+
+// parseWalletEndpoint parses a wallet endpoint given as
+// host,user,password,cert[,account].  The account defaults to account.
+func parseWalletEndpoint(s, account string) (walletEndpoint, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 4 && len(fields) != 5 {
+		return walletEndpoint{}, fmt.Errorf("wallet %q is not in the "+
+			"form host,user,password,cert[,account]", s)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+		if fields[i] == "" {
+			return walletEndpoint{}, fmt.Errorf("wallet %q: empty "+
+				"field", s)
+		}
+	}
+
+	e := walletEndpoint{
+		Host:     normalizeAddress(fields[0], activeNetParams.WalletRPCServerPort),
+		User:     fields[1],
+		Password: fields[2],
+		Cert:     cleanAndExpandPath(fields[3]),
+		Account:  account,
+	}
+	if len(fields) == 5 {
+		e.Account = fields[4]
+	}
+	if !fileExists(e.Cert) {
+		return walletEndpoint{}, fmt.Errorf("wallet %q: cert %s does "+
+			"not exist", s, e.Cert)
+	}
+	return e, nil
+}
+
+// walletBackend is a connection to one of the wallets payouts are sent from.
+type walletBackend struct {
+	endpoint walletEndpoint
+	priority int
+	rpc      *rpcclient.Client
+	client   *dcrwallet.Client
+
+	mtx     sync.Mutex
+	healthy bool
+	reason  string
+	balance walletBalance
+}
+
+// String returns the host of the wallet.
+func (w *walletBackend) String() string {
+	return w.endpoint.Host
+}
+
+// setHealth records whether the wallet can be used for payouts, logging
+// changes.
+func (w *walletBackend) setHealth(healthy bool, reason string) {
+	w.mtx.Lock()
+	changed := w.healthy != healthy
+	w.healthy, w.reason = healthy, reason
+	w.mtx.Unlock()
+
+	switch {
+	case changed && healthy:
+		walletLog.Infof("Wallet %s is healthy", w)
+	case changed:
+		walletLog.Warnf("Wallet %s is unhealthy: %s", w, reason)
+	}
+}
+
+// isHealthy returns whether the wallet passed its last health check.
+func (w *walletBackend) isHealthy() bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.healthy
+}
+
+// check checks whether the wallet is connected, synced and unlocked.
+func (w *walletBackend) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, walletHealthInterval/2)
+	defer cancel()
+
+	info, err := w.client.WalletInfo(ctx)
+	switch {
+	case err != nil:
+		w.setHealth(false, err.Error())
+	case !info.DaemonConnected:
+		w.setHealth(false, "not connected to the network")
+	case !info.Unlocked:
+		w.setHealth(false, "wallet is locked")
+	default:
+		w.setHealth(true, "")
+	}
+}
+
+// fetchBalance requests the balance breakdown of the account of the wallet.
+//
+// The balance is requested with one confirmation so that confirmed and
+// unconfirmed funds are reported separately.
+func (w *walletBackend) fetchBalance(ctx context.Context) (walletBalance, error) {
+	gbr, err := w.client.GetBalanceMinConf(ctx, w.endpoint.Account, 1)
+	if err != nil {
+		return walletBalance{}, err
+	}
+
+	var balance walletBalance
+	for _, b := range gbr.Balances {
+		for _, v := range []struct {
+			total *dcrutil.Amount
+			value float64
+		}{
+			{&balance.Spendable, b.Spendable},
+			{&balance.Unconfirmed, b.Unconfirmed},
+			{&balance.Immature, b.ImmatureCoinbaseRewards},
+			{&balance.Immature, b.ImmatureStakeGeneration},
+			{&balance.LockedByTickets, b.LockedByTickets},
+			{&balance.VotingAuthority, b.VotingAuthority},
+			{&balance.Total, b.Total},
+		} {
+			amt, err := dcrutil.NewAmount(v.value)
+			if err != nil {
+				log.Warnf("NewAmount error: %v", err)
+				continue
+			}
+			*v.total += amt
+		}
+	}
+
+	w.mtx.Lock()
+	w.balance = balance
+	w.mtx.Unlock()
+	return balance, nil
+}
+
+// walletStatus describes a wallet in the admin status API.  Available is in
+// DCR.
+type walletStatus struct {
+	Host      string  `json:"host"`
+	Account   string  `json:"account"`
+	Priority  int     `json:"priority"`
+	Healthy   bool    `json:"healthy"`
+	Reason    string  `json:"reason,omitempty"`
+	Available float64 `json:"available"`
+}
+
+// walletSet is the set of wallets payouts are sent from, in order of
+// priority.  The first wallet is the one configured by wallethost, which is
+// also used for return addresses and UTXO pool management.
+type walletSet struct {
+	backends []*walletBackend
+}
+
+// wallets holds the wallets payouts are sent from.  It is created in main.
+var wallets *walletSet
+
+// connectWallets creates an RPC client for every endpoint.  The connection
+// to the primary wallet is established before returning, while the other
+// wallets are connected in the background so that a wallet which is down does
+// not prevent the faucet from starting.
+func connectWallets(ctx context.Context, endpoints []walletEndpoint) (*walletSet, error) {
+	s := new(walletSet)
+	for i, e := range endpoints {
+		certs, err := os.ReadFile(e.Cert)
+		if err != nil {
+			s.disconnect()
+			return nil, fmt.Errorf("failed to read cert file of "+
+				"wallet %s: %v", e.Host, err)
+		}
+		walletLog.Infof("Attempting to connect to dcrwallet RPC %s as "+
+			"user %s using certificate located in %s", e.Host,
+			e.User, e.Cert)
+		rpc, err := rpcclient.New(&rpcclient.ConnConfig{
+			Host:                e.Host,
+			Endpoint:            "ws",
+			User:                e.User,
+			Pass:                e.Password,
+			Certificates:        certs,
+			DisableConnectOnNew: i > 0,
+		}, connectHandlers())
+		if err != nil {
+			s.disconnect()
+			return nil, fmt.Errorf("failed to connect to wallet %s: "+
+				"%v", e.Host, err)
+		}
+
+		w := &walletBackend{
+			endpoint: e,
+			priority: i,
+			rpc:      rpc,
+			client: dcrwallet.NewClient(dcrwallet.RawRequestCaller(rpc),
+				chaincfg.TestNet3Params()),
+		}
+		s.backends = append(s.backends, w)
+
+		if i == 0 {
+			continue
+		}
+		go func() {
+			if err := w.rpc.Connect(ctx, true); err != nil {
+				return
+			}
+			walletLog.Infof("Connected to wallet %s", w)
+			w.check(ctx)
+		}()
+	}
+	return s, nil
+}
+
+// primary returns the client of the primary wallet.
+func (s *walletSet) primary() *dcrwallet.Client {
+	return s.backends[0].client
+}
+
+// checkHealth checks the health of every wallet and updates the metrics.
+func (s *walletSet) checkHealth(ctx context.Context) {
+	var healthy int64
+	for _, w := range s.backends {
+		w.check(ctx)
+		if w.isHealthy() {
+			healthy++
+		}
+	}
+	metricWalletsHealthy.Set(healthy)
+}
+
+// monitor checks the health of the wallets every walletHealthInterval until
+// quit is closed.
+func (s *walletSet) monitor(quit <-chan struct{}) {
+	ticker := time.NewTicker(walletHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			s.checkHealth(context.Background())
+		}
+	}
+}
+
+// isFailoverError returns whether err shows that a payout request never
+// reached the wallet, or was refused by it before building a transaction, so
+// that the payout can safely be sent from another wallet.  Errors such as a
+// connection lost while the request was in flight are ambiguous, since the
+// payout may have been sent, and do not qualify.
+func isFailoverError(err error) bool {
+	if errors.Is(err, rpcclient.ErrClientNotConnected) ||
+		errors.Is(err, rpcclient.ErrClientShutdown) {
+		return true
+	}
+	var rpcErr *dcrjson.RPCError
+	if errors.As(err, &rpcErr) {
+		switch rpcErr.Code {
+		case dcrjson.ErrRPCClientNotConnected,
+			dcrjson.ErrRPCClientInInitialDownload:
+			return true
+		}
+	}
+	return false
+}
+
+// payment is an output paying amount to address in a payout transaction.
+type payment struct {
+	address stdaddr.Address
+	amount  dcrutil.Amount
+}
+
+// buildTransaction returns a transaction making the payments which is funded
+// from outputs with at least minConf confirmations and signed by wallet w, but
+// not broadcast.  A non-empty memo is committed in a null-data output.
+func (w *walletBackend) buildTransaction(ctx context.Context, payments []payment,
+	minConf int, memo []byte) (*wire.MsgTx, error) {
+
+	tx := wire.NewMsgTx()
+	for _, p := range payments {
+		version, script := p.address.PaymentScript()
+		tx.AddTxOut(&wire.TxOut{
+			Value:    int64(p.amount),
+			Version:  version,
+			PkScript: script,
+		})
+	}
+	if len(memo) > 0 {
+		nullData, err := txscript.NewScriptBuilder().
+			AddOp(txscript.OP_RETURN).AddData(memo).Script()
+		if err != nil {
+			return nil, err
+		}
+		tx.AddTxOut(wire.NewTxOut(0, nullData))
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(tx.SerializeSize())
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	confs := int32(minConf)
+	options := types.FundRawTransactionOptions{ConfTarget: &confs}
+	if cfg.feeRate > 0 {
+		feeRate := cfg.feeRate.ToCoin()
+		options.FeeRate = &feeRate
+	}
+	funded, err := w.client.FundRawTransaction(ctx, hex.EncodeToString(buf.Bytes()),
+		w.endpoint.Account, options)
+	if err != nil {
+		return nil, err
+	}
+	tx = wire.NewMsgTx()
+	if err := tx.Deserialize(hex.NewDecoder(strings.NewReader(funded.Hex))); err != nil {
+		return nil, err
+	}
+	signed, complete, err := w.client.SignRawTransaction(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+	if !complete {
+		return nil, errors.New("wallet could not sign all inputs")
+	}
+	return signed, nil
+}
+
+// sendWithMemo makes the payments in a transaction which also commits memo in
+// a null-data output.  The transaction is funded and signed by the wallet
+// before it is broadcast.  The wallet does not lock the inputs it selects for
+// funding, so they are locked right after, until the transaction is broadcast.
+// Until they are locked, only requestMtx, which the caller must hold, keeps
+// other transactions of the faucet from selecting the same inputs.
+func (w *walletBackend) sendWithMemo(ctx context.Context, payments []payment,
+	minConf int, memo []byte) (*chainhash.Hash, error) {
+
+	tx, err := w.buildTransaction(ctx, payments, minConf, memo)
+	if err != nil {
+		return nil, err
+	}
+	inputs := make([]*wire.OutPoint, 0, len(tx.TxIn))
+	for _, in := range tx.TxIn {
+		op := in.PreviousOutPoint
+		inputs = append(inputs, &op)
+	}
+	// Unlocking an empty list would release every locked output.
+	if len(inputs) == 0 {
+		return nil, errors.New("funded transaction has no inputs")
+	}
+	if err := w.client.LockUnspent(ctx, false, inputs); err != nil {
+		return nil, err
+	}
+	defer func() {
+		// The inputs of a broadcast transaction are spent, so this
+		// only makes a difference when the broadcast failed.
+		err := w.client.LockUnspent(context.Background(), true, inputs)
+		if err != nil {
+			walletLog.Warnf("Unable to unlock inputs of wallet %s: %v",
+				w, err)
+		}
+	}()
+	var buf bytes.Buffer
+	buf.Grow(tx.SerializeSize())
+	if err := tx.Serialize(&buf); err != nil {
+		return nil, err
+	}
+	var txid string
+	err = w.client.Call(ctx, "sendrawtransaction", &txid,
+		hex.EncodeToString(buf.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	return chainhash.NewHashFromStr(txid)
+}
+
+// sendFrom sends amount to address from the first healthy wallet in priority
+// order.  See sendMany.
+func (s *walletSet) sendFrom(ctx context.Context, address stdaddr.Address,
+	amount dcrutil.Amount, minConf int, memo []byte) (*chainhash.Hash, *walletBackend, dcrutil.Amount, error) {
+
+	return s.sendMany(ctx, []payment{{address, amount}}, minConf, memo)
+}
+
+// sendMany makes the payments in a single transaction from the first healthy
+// wallet in priority order, spending outputs with at least minConf
+// confirmations.  A non-empty memo is committed in a null-data output of the
+// transaction.  The next healthy wallet is only tried when the payments
+// certainly were not sent, including when the wallet lacks the funds.  Since
+// the transaction limit follows the largest wallet, the payments may well fit
+// a lower priority wallet.  The wallet which sent the payments is returned
+// along with the txid and fee.  In dry-run mode the transaction is only
+// simulated.
+func (s *walletSet) sendMany(ctx context.Context, payments []payment,
+	minConf int, memo []byte) (*chainhash.Hash, *walletBackend, dcrutil.Amount, error) {
+
+	var total dcrutil.Amount
+	for _, p := range payments {
+		total += p.amount
+	}
+	var insufficient error
+	for _, w := range s.backends {
+		if !w.isHealthy() || w.rpc.Disconnected() {
+			continue
+		}
+		err := w.applyFeeRate(ctx)
+		if err != nil && isFailoverError(err) {
+			walletLog.Warnf("Failed to set the fee rate of wallet %s, "+
+				"trying the next wallet: %v", w, err)
+			w.setHealth(false, err.Error())
+			continue
+		}
+		if err != nil {
+			return nil, w, 0, err
+		}
+		var hash *chainhash.Hash
+		var fee dcrutil.Amount
+		switch {
+		case cfg.DryRun:
+			hash, fee, err = w.simulate(ctx, payments, minConf, memo)
+		case len(memo) > 0:
+			hash, err = w.sendWithMemo(ctx, payments, minConf, memo)
+		case len(payments) == 1:
+			hash, err = w.client.SendFromMinConf(ctx,
+				w.endpoint.Account, payments[0].address,
+				payments[0].amount, minConf)
+		default:
+			amounts := make(map[stdaddr.Address]dcrutil.Amount,
+				len(payments))
+			for _, p := range payments {
+				amounts[p.address] = p.amount
+			}
+			hash, err = w.client.SendManyMinConf(ctx,
+				w.endpoint.Account, amounts, minConf)
+		}
+		if err != nil && isFailoverError(err) {
+			walletLog.Warnf("Failed to send %v from wallet %s, trying "+
+				"the next wallet: %v", total, w, err)
+			w.setHealth(false, err.Error())
+			continue
+		}
+		if isInsufficientFundsError(err) {
+			walletLog.Debugf("Wallet %s cannot fund %v, trying the "+
+				"next wallet: %v", w, total, err)
+			insufficient = err
+			continue
+		}
+		if err == nil && !cfg.DryRun {
+			fee = w.transactionFee(ctx, hash)
+		}
+		return hash, w, fee, err
+	}
+	if insufficient != nil {
+		return nil, nil, 0, insufficient
+	}
+	return nil, nil, 0, errNoWallet
+}
+
+// status returns the state of every wallet.
+func (s *walletSet) status() []walletStatus {
+	statuses := make([]walletStatus, 0, len(s.backends))
+	for _, w := range s.backends {
+		w.mtx.Lock()
+		statuses = append(statuses, walletStatus{
+			Host:      w.endpoint.Host,
+			Account:   w.endpoint.Account,
+			Priority:  w.priority,
+			Healthy:   w.healthy,
+			Reason:    w.reason,
+			Available: w.balance.available().ToCoin(),
+		})
+		w.mtx.Unlock()
+	}
+	return statuses
+}
+
+// disconnect shuts down the connections to all wallets.
+func (s *walletSet) disconnect() {
+	for _, w := range s.backends {
+		w.rpc.Shutdown()
+	}
+}